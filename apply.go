@@ -4,52 +4,116 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/badgerodon/stack/archive"
-	"github.com/badgerodon/stack/service"
+	"github.com/badgerodon/stack/logging"
 	"github.com/badgerodon/stack/storage"
 )
 
+type (
+	// an applyError is an apply error along with the stage and application
+	// it happened in
+	applyError struct {
+		stage       string
+		application string
+		err         error
+	}
+)
+
+// apply stages
+const (
+	stageDownload = "download"
+	stageExtract  = "extract"
+	stageInstall  = "install"
+)
+
+func (err applyError) Error() string {
+	return err.err.Error()
+}
+
+// errorDetails returns the stage and application of an apply error
+func errorDetails(err error) applyError {
+	if ae, ok := err.(applyError); ok {
+		return ae
+	}
+	return applyError{stage: stageInstall, err: err}
+}
+
+// wrapApplyError adds context to an apply error, keeping its details
+func wrapApplyError(err error, stage, format string) error {
+	ae, ok := err.(applyError)
+	if !ok {
+		ae = applyError{stage: stage}
+	}
+	ae.err = fmt.Errorf(format, err)
+	return ae
+}
+
 func apply(src string) error {
-	pl := NewPortLock(49001)
-	pl.Lock()
-	defer pl.Unlock()
+	cfg, err := readConfig(src)
+	if err != nil {
+		return err
+	}
+	err = applyConfig(cfg)
+	notifyApply(cfg.Notifications, err)
+	waitNotifications()
+	return err
+}
 
+// readConfig downloads and parses the config file at src
+func readConfig(src string) (*Config, error) {
 	loc, err := storage.ParseLocation(src)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	rc, err := storage.Get(loc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rc.Close()
 
-	cfg, err := ParseConfig(rc)
-	if err != nil {
-		return err
-	}
+	return ParseConfig(rc)
+}
+
+func applyConfig(cfg *Config) (err error) {
+	pl := NewPortLock(49001)
+	pl.Lock()
+	defer pl.Unlock()
+
+	start := time.Now()
+	defer func() {
+		stackMetrics.recordApply(start, err)
+	}()
 
 	state := ReadStackState()
 
+	sourceVersions(state, cfg)
+	cfg = applyRollouts(state, cfg)
+
 	err = applySources(state, cfg)
 	if err != nil {
-		return fmt.Errorf("error processing sources: %v", err)
+		return wrapApplyError(err, stageDownload, "error processing sources: %v")
+	}
+
+	err = allocatePorts(state, cfg)
+	if err != nil {
+		return fmt.Errorf("error allocating ports: %v", err)
 	}
 
 	err = applyApplications(state, cfg)
 	if err != nil {
-		return fmt.Errorf("error processing applications: %v", err)
+		return wrapApplyError(err, stageInstall, "error processing applications: %v")
 	}
 
 	return nil
 }
 
 func applyApplications(state *StackState, newCfg *Config) error {
-	for _, pa := range state.Applications {
+	for i := 0; i < len(state.Applications); i++ {
+		pa := state.Applications[i]
 		found := false
 		for _, na := range newCfg.Applications {
 			if pa.Hash() == na.Hash() {
@@ -58,17 +122,23 @@ func applyApplications(state *StackState, newCfg *Config) error {
 			}
 		}
 		if !found {
-			log.Println("[install] [application] remove service", pa.ServiceName())
-			err := serviceManager.Uninstall(pa.ServiceName())
-			if err != nil {
-				return err
+			for _, name := range pa.ServiceNames() {
+				logging.Info("remove service", "app", pa.Name, "service", name, "stage", stageInstall)
+				err := serviceManager.Uninstall(name)
+				if err != nil {
+					return applyError{stageInstall, pa.Name, err}
+				}
 			}
 
-			log.Println("[install] [application] remove folder", pa.ApplicationPath())
-			err = os.RemoveAll(pa.ApplicationPath())
+			logging.Info("remove folder", "app", pa.Name, "path", pa.ApplicationPath(), "stage", stageInstall)
+			err := os.RemoveAll(pa.ApplicationPath())
 			if err != nil {
-				return err
+				return applyError{stageInstall, pa.Name, err}
 			}
+
+			state.Applications = append(state.Applications[:i], state.Applications[i+1:]...)
+			i--
+			SaveStackState(state)
 		}
 	}
 	for _, na := range newCfg.Applications {
@@ -80,64 +150,92 @@ func applyApplications(state *StackState, newCfg *Config) error {
 			}
 		}
 		if found {
-			log.Println("[install] [application] skip", na.Name)
+			logging.Debug("skip application", "app", na.Name)
 		} else {
-			log.Println("[install] [application] extract folder", na.ApplicationPath())
+			logging.Info("extract folder", "app", na.Name, "path", na.ApplicationPath(), "stage", stageExtract)
 			err := archive.Extract(na.ApplicationPath(), na.DownloadPath())
 			if err != nil {
-				return fmt.Errorf("error extracting folder: %v", err)
+				return applyError{stageExtract, na.Name, fmt.Errorf("error extracting folder: %v", err)}
 			}
 
 			for name, target := range na.Links {
 				fp := filepath.Join(na.ApplicationPath(), name)
 				tp := filepath.Join(na.ApplicationPath(), target)
-				log.Println("[install] [application] add link", fp)
+				logging.Info("add link", "app", na.Name, "path", fp, "stage", stageInstall)
 				err := os.Link(tp, fp)
 				if err != nil {
-					return fmt.Errorf("error creating link: %v", err)
+					return applyError{stageInstall, na.Name, fmt.Errorf("error creating link: %v", err)}
 				}
 			}
 			for name, content := range na.Files {
 				fp := filepath.Join(na.ApplicationPath(), name)
-				log.Println("[install] [application] add file", fp)
+				logging.Info("add file", "app", na.Name, "path", fp, "stage", stageInstall)
 				err := ioutil.WriteFile(fp, []byte(content), 0755)
 				if err != nil {
-					return fmt.Errorf("error creating file: %v", err)
+					return applyError{stageInstall, na.Name, fmt.Errorf("error creating file: %v", err)}
 				}
 			}
 
-			if len(na.Service.Command) > 0 {
-				log.Println("[install] [application] install service", na.ServiceName())
-				err = serviceManager.Install(service.Service{
-					Name:        na.ServiceName(),
-					Directory:   na.ApplicationPath(),
-					Command:     na.Service.Command,
-					Environment: na.Service.Environment,
-				})
+			err = runTasks(state, na, portEnvironment(state, na))
+			if err != nil {
+				// remove the folder so the next attempt starts from scratch
+				os.RemoveAll(na.ApplicationPath())
+				return applyError{stageInstall, na.Name, fmt.Errorf("error running tasks: %v", err)}
+			}
+
+			services, err := na.Services(portEnvironment(state, na))
+			if err != nil {
+				return applyError{stageInstall, na.Name, fmt.Errorf("error installing service: %v", err)}
+			}
+			for _, svc := range services {
+				logging.Info("install service", "app", na.Name, "service", svc.Name, "stage", stageInstall)
+				err = serviceManager.Install(svc)
 				if err != nil {
-					return fmt.Errorf("error installing service: %v", err)
+					return applyError{stageInstall, na.Name, fmt.Errorf("error installing service: %v", err)}
 				}
 			}
 
 			state.Applications = append(state.Applications, na)
+			rolloutInstalled(state, na)
 			SaveStackState(state)
 		}
 	}
+	pruneTasks(state, newCfg)
 	return nil
 }
 
+// sourceVersions sets the versions of watched sources
+func sourceVersions(state *StackState, newCfg *Config) {
+	for i := range newCfg.Applications {
+		app := &newCfg.Applications[i]
+		if !app.Watch {
+			continue
+		}
+		previous := state.Downloads[app.DownloadPath()]
+		version, err := storage.Version(app.Source, previous.Version)
+		if err != nil {
+			logging.Warn("error checking source version", "app", app.Name, "location", app.Source, "error", err)
+			// keep the existing download
+			if previous.Hash == app.SourceHash() {
+				version = previous.Version
+			}
+		}
+		app.SourceVersion = version
+	}
+}
+
 func applySources(state *StackState, newCfg *Config) error {
 	// remove
-	for path, hash := range state.Downloads {
+	for path, download := range state.Downloads {
 		found := false
 		for _, app := range newCfg.Applications {
-			if app.DownloadPath() == path && app.SourceHash() == hash {
+			if app.DownloadPath() == path && app.SourceHash() == download.Hash && app.SourceVersion == download.Version {
 				found = true
 				break
 			}
 		}
 		if !found {
-			log.Println("[install] [source] remove", path)
+			logging.Info("remove download", "path", path, "stage", stageDownload)
 			os.Remove(path)
 
 			delete(state.Downloads, path)
@@ -153,26 +251,26 @@ func applySources(state *StackState, newCfg *Config) error {
 			// above
 			continue
 		}
-		log.Println("[install] [source] download", path, app.Source)
+		logging.Info("download", "app", app.Name, "path", path, "location", app.Source, "version", app.SourceVersion, "stage", stageDownload)
 
 		rc, err := storage.Get(app.Source)
 		if err != nil {
-			return fmt.Errorf("error downloading: %v", err)
+			return applyError{stageDownload, app.Name, fmt.Errorf("error downloading: %v", err)}
 		}
 		//TODO: make this an atomic update
 		f, err := os.Create(path)
 		if err != nil {
 			rc.Close()
-			return fmt.Errorf("error creating download file: %v", err)
+			return applyError{stageDownload, app.Name, fmt.Errorf("error creating download file: %v", err)}
 		}
 		_, err = io.Copy(f, rc)
 		rc.Close()
 		f.Close()
 		if err != nil {
-			return fmt.Errorf("error downloading: %v", err)
+			return applyError{stageDownload, app.Name, fmt.Errorf("error downloading: %v", err)}
 		}
 
-		state.Downloads[path] = hash
+		state.Downloads[path] = Download{Hash: hash, Version: app.SourceVersion}
 		SaveStackState(state)
 	}
 	return nil
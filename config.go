@@ -5,17 +5,21 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/badgerodon/stack/cron"
+	"github.com/badgerodon/stack/logging"
 	"github.com/badgerodon/stack/service"
 	"github.com/badgerodon/stack/storage"
+	stacksync "github.com/badgerodon/stack/sync"
 	"github.com/minio/blake2b-simd"
 )
 
@@ -52,7 +56,7 @@ func init() {
 		if isRoot {
 			rootDir = "/opt/stack"
 			if isUpstart() {
-				serviceManager = service.NewUpstartServiceManager()
+				serviceManager = service.NewUpstartServiceManager(filepath.Join(rootDir, "run"))
 			} else if isSystemD() {
 				if _, err := os.Stat("/usr/lib/systemd/system"); err == nil {
 					serviceManager = service.NewSystemDManager("/usr/lib/systemd/system/", false)
@@ -85,22 +89,87 @@ type (
 	// StackState is the local state of the badgerodon stack
 	StackState struct {
 		Applications []Application `yaml:"applications"`
-		Downloads    map[string]string
+		Downloads    map[string]Download
+		// Ports are the allocated ports by application and port name
+		Ports map[string]map[string]int
+		// Tasks are the names of the tasks which have completed successfully
+		// by the application's TaskKey
+		Tasks map[string][]string
+		// Stack identifies the installed stack binary update
+		Stack string
+		// Rollouts track new versions of applications with a rollout policy
+		// by application hash
+		Rollouts map[string]RolloutState
 	}
 
 	Config struct {
-		Applications []Application `yaml:"applications"`
+		Applications  []Application  `yaml:"applications"`
+		Ports         PortRange      `yaml:"ports,omitempty"`
+		Stack         StackUpdate    `yaml:"stack,omitempty"`
+		Notifications []Notification `yaml:"notifications,omitempty"`
+		// Watch controls how often `watch` polls for a new version of the
+		// config
+		Watch stacksync.Options `yaml:"watch,omitempty"`
+		// Maintenance restricts when `watch` applies new versions
+		Maintenance []MaintenanceWindow `yaml:"maintenance,omitempty"`
+	}
+	// A Download is a downloaded application source
+	Download struct {
+		// Hash is the SourceHash of the application
+		Hash string
+		// Version is the storage.Version of the source when it was
+		// downloaded, only tracked for watched applications
+		Version string `json:",omitempty"`
 	}
 	Application struct {
 		Name    string             `yaml:"name"`
 		Source  storage.Location   `yaml:"source"`
 		Links   map[string]string  `yaml:"links,omitempty"`
 		Files   map[string]string  `yaml:"files,omitempty"`
+		Ports   []string           `yaml:"ports,omitempty"`
 		Service ApplicationService `yaml:"service,omitempty"`
+		// Schedule is a cron expression. If set the service is run as a job at
+		// the given times instead of being kept running.
+		Schedule string `yaml:"schedule,omitempty"`
+		// Tasks are run to completion once per version of the application,
+		// before its services are started
+		Tasks []ApplicationTask `yaml:"tasks,omitempty"`
+		// Processes are additional services run from the same extracted
+		// application, ie a web process and a worker
+		Processes map[string]ApplicationProcess `yaml:"processes,omitempty"`
+		// Watch tracks the version of the source, so that a new artifact
+		// published at the same location is downloaded and installed
+		Watch bool `yaml:"watch,omitempty" json:",omitempty"`
+		// SourceVersion is the version of a watched source. It's part of the
+		// hash so a new version is reinstalled.
+		SourceVersion string `yaml:"-" json:",omitempty"`
+		// Rollout stages new versions of the application across hosts
+		Rollout ApplicationRollout `yaml:"rollout,omitempty" json:"-"`
 	}
 	ApplicationService struct {
 		Command     []string          `yaml:"command,omitempty"`
 		Environment map[string]string `yaml:"environment,omitempty"`
+		EnvFiles    EnvFiles          `yaml:"env_file,omitempty"`
+		InheritEnv  InheritPolicy     `yaml:"inherit_env,omitempty"`
+		Limits      ApplicationLimits `yaml:"limits,omitempty"`
+	}
+	// ApplicationLimits restrict the resources available to a service
+	ApplicationLimits struct {
+		// Memory is a size in bytes with an optional K, M, G or T suffix
+		Memory string `yaml:"memory,omitempty"`
+		// CPU is a percentage of a single CPU, ie 50%
+		CPU    string `yaml:"cpu,omitempty"`
+		NoFile uint64 `yaml:"nofile,omitempty"`
+	}
+	// An ApplicationProcess is a named service with its own instance count
+	ApplicationProcess struct {
+		ApplicationService `yaml:",inline"`
+		Instances          int `yaml:"instances,omitempty"`
+	}
+	// An ApplicationTask is a command run once per version of an application
+	ApplicationTask struct {
+		Name               string `yaml:"name"`
+		ApplicationService `yaml:",inline"`
 	}
 )
 
@@ -109,26 +178,112 @@ func (as *ApplicationService) UnmarshalYAML(unmarshal func(interface{}) error) e
 	var t1 struct {
 		Command     []string          `yaml:"command,omitempty"`
 		Environment map[string]string `yaml:"environment,omitempty"`
+		EnvFiles    EnvFiles          `yaml:"env_file,omitempty"`
+		InheritEnv  InheritPolicy     `yaml:"inherit_env,omitempty"`
+		Limits      ApplicationLimits `yaml:"limits,omitempty"`
 	}
 	err := unmarshal(&t1)
 	if err == nil {
 		as.Command = t1.Command
 		as.Environment = t1.Environment
+		as.EnvFiles = t1.EnvFiles
+		as.InheritEnv = t1.InheritEnv
+		as.Limits = t1.Limits
 		return nil
 	}
 	var t2 struct {
 		Command     string            `yaml:"command,omitempty"`
 		Environment map[string]string `yaml:"environment,omitempty"`
+		EnvFiles    EnvFiles          `yaml:"env_file,omitempty"`
+		InheritEnv  InheritPolicy     `yaml:"inherit_env,omitempty"`
+		Limits      ApplicationLimits `yaml:"limits,omitempty"`
 	}
 	err = unmarshal(&t2)
 	if err == nil {
 		as.Command = strings.Fields(t2.Command)
 		as.Environment = t2.Environment
+		as.EnvFiles = t2.EnvFiles
+		as.InheritEnv = t2.InheritEnv
+		as.Limits = t2.Limits
 		return nil
 	}
 	return err
 }
 
+// UnmarshalYAML unmarshals a yaml structure
+func (ap *ApplicationProcess) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	err := unmarshal(&ap.ApplicationService)
+	if err != nil {
+		return err
+	}
+	var t struct {
+		Instances int `yaml:"instances,omitempty"`
+	}
+	err = unmarshal(&t)
+	if err != nil {
+		return err
+	}
+	ap.Instances = t.Instances
+	return nil
+}
+
+// UnmarshalYAML unmarshals a yaml structure
+func (at *ApplicationTask) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	err := unmarshal(&at.ApplicationService)
+	if err != nil {
+		return err
+	}
+	var t struct {
+		Name string `yaml:"name"`
+	}
+	err = unmarshal(&t)
+	if err != nil {
+		return err
+	}
+	at.Name = t.Name
+	return nil
+}
+
+var sizeSuffixes = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+}
+
+// ServiceLimits converts the limits into the form used by service managers
+func (al ApplicationLimits) ServiceLimits() (service.Limits, error) {
+	limits := service.Limits{
+		NoFile: al.NoFile,
+	}
+
+	if al.Memory != "" {
+		str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(al.Memory)), "B")
+		multiplier := int64(1)
+		if len(str) > 0 {
+			if m, ok := sizeSuffixes[str[len(str)-1]]; ok {
+				multiplier = m
+				str = str[:len(str)-1]
+			}
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+		if err != nil || n <= 0 {
+			return limits, fmt.Errorf("invalid memory limit: %s", al.Memory)
+		}
+		limits.Memory = n * multiplier
+	}
+
+	if al.CPU != "" {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(al.CPU), "%"))
+		if err != nil || n <= 0 {
+			return limits, fmt.Errorf("invalid cpu limit: %s", al.CPU)
+		}
+		limits.CPUQuota = n
+	}
+
+	return limits, nil
+}
+
 func (a Application) ApplicationPath() string {
 	return filepath.Join(rootDir, "applications", a.Name)
 }
@@ -149,17 +304,137 @@ func (a Application) SourceHash() string {
 	return fmt.Sprintf("%X", blake2b.Sum512(bs))
 }
 
+// TaskKey identifies the version of an application its tasks run once for:
+// its source and the version of the source. Changes to the rest of the
+// application, ie its environment or ports, don't run the tasks again.
+func (a Application) TaskKey() string {
+	return a.Name + "/" + a.SourceHash() + "/" + a.SourceVersion
+}
+
 func (a Application) ServiceName() string {
 	return "stack-" + a.Name
 }
 
+func (a Application) processNames() []string {
+	names := make([]string, 0, len(a.Processes))
+	for name := range a.Processes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServiceNames returns the names of all the services run by the application
+func (a Application) ServiceNames() []string {
+	var names []string
+	if len(a.Service.Command) > 0 {
+		names = append(names, a.ServiceName())
+	}
+	for _, name := range a.processNames() {
+		proc := a.Processes[name]
+		if proc.Instances <= 1 {
+			names = append(names, a.ServiceName()+"-"+name)
+			continue
+		}
+		for i := 1; i <= proc.Instances; i++ {
+			names = append(names, fmt.Sprintf("%s-%s-%d", a.ServiceName(), name, i))
+		}
+	}
+	return names
+}
+
+// Services returns the definitions of all the services run by the
+// application. Processes share the application's directory and inherit its
+// service environment. The extra environment is set for every service.
+func (a Application) Services(extra map[string]string) ([]service.Service, error) {
+	var services []service.Service
+	if len(a.Service.Command) > 0 {
+		limits, err := a.Service.Limits.ServiceLimits()
+		if err != nil {
+			return nil, err
+		}
+		env, err := a.Service.environment(a.ApplicationPath(), extra)
+		if err != nil {
+			return nil, err
+		}
+		if a.Schedule != "" {
+			if _, err := cron.Parse(a.Schedule); err != nil {
+				return nil, err
+			}
+		}
+		services = append(services, service.Service{
+			Name:        a.ServiceName(),
+			Directory:   a.ApplicationPath(),
+			Command:     a.Service.Command,
+			Environment: env,
+			Limits:      limits,
+			Schedule:    a.Schedule,
+		})
+	}
+	for _, name := range a.processNames() {
+		proc := a.Processes[name]
+		if len(proc.Command) == 0 {
+			return nil, fmt.Errorf("process %s has no command", name)
+		}
+		limits, err := proc.Limits.ServiceLimits()
+		if err != nil {
+			return nil, fmt.Errorf("process %s: %v", name, err)
+		}
+		instances := proc.Instances
+		if instances < 1 {
+			instances = 1
+		}
+		for i := 1; i <= instances; i++ {
+			env, err := a.Service.environment(a.ApplicationPath(), extra, proc.ApplicationService)
+			if err != nil {
+				return nil, fmt.Errorf("process %s: %v", name, err)
+			}
+			svcName := a.ServiceName() + "-" + name
+			if proc.Instances > 1 {
+				svcName = fmt.Sprintf("%s-%d", svcName, i)
+				env["STACK_INSTANCE"] = strconv.Itoa(i)
+			}
+			services = append(services, service.Service{
+				Name:        svcName,
+				Directory:   a.ApplicationPath(),
+				Command:     proc.Command,
+				Environment: env,
+				Limits:      limits,
+			})
+		}
+	}
+	return services, nil
+}
+
+// UnmarshalJSON reads a download, which used to be stored as just the hash
+func (d *Download) UnmarshalJSON(bs []byte) error {
+	var hash string
+	if json.Unmarshal(bs, &hash) == nil {
+		*d = Download{Hash: hash}
+		return nil
+	}
+	type download Download
+	return json.Unmarshal(bs, (*download)(d))
+}
+
+// ReadStackState loads the stack state and validates it against the
+// applications and services actually installed. Validating removes anything
+// that isn't tracked, so it must only be called while holding the apply lock.
 func ReadStackState() *StackState {
+	state := LoadStackState()
+	Validate(state)
+	return state
+}
+
+// LoadStackState loads the stack state without validating it, for readers
+// that run alongside an apply
+func LoadStackState() *StackState {
 	state := &StackState{}
 	bs, err := ioutil.ReadFile(filepath.Join(rootDir, "state.json"))
 	if err == nil {
 		err = json.Unmarshal(bs, state)
 		if err != nil {
-			log.Println("[ReadStackState] error unmarshaling:", err)
+			logging.Error("error reading stack state", "error", err)
 		}
 	}
 
@@ -167,10 +442,17 @@ func ReadStackState() *StackState {
 		state.Applications = make([]Application, 0)
 	}
 	if state.Downloads == nil {
-		state.Downloads = make(map[string]string)
+		state.Downloads = make(map[string]Download)
+	}
+	if state.Ports == nil {
+		state.Ports = make(map[string]map[string]int)
+	}
+	if state.Tasks == nil {
+		state.Tasks = make(map[string][]string)
+	}
+	if state.Rollouts == nil {
+		state.Rollouts = make(map[string]RolloutState)
 	}
-
-	Validate(state)
 
 	return state
 }
@@ -178,11 +460,11 @@ func ReadStackState() *StackState {
 func SaveStackState(state *StackState) {
 	out, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
-		log.Println("[SaveStackState] error marshaling:", err)
+		logging.Error("error saving stack state", "error", err)
 		return
 	}
 	ioutil.WriteFile(filepath.Join(rootDir, "state.json"), out, 0755)
-	log.Println("[SaveStackState] saved state:", string(out))
+	logging.Debug("saved stack state", "path", filepath.Join(rootDir, "state.json"))
 }
 
 func ParseConfig(rdr io.Reader) (*Config, error) {
@@ -206,7 +488,7 @@ func Validate(state *StackState) {
 			return nil
 		}
 		if !fi.IsDir() {
-			log.Println("[config] removing file in applications:", p)
+			logging.Warn("remove file in applications", "path", p)
 			os.Remove(p)
 			return nil
 		}
@@ -217,7 +499,7 @@ func Validate(state *StackState) {
 	existingServices := map[string]struct{}{}
 	services, err := serviceManager.List()
 	if err != nil {
-		log.Println("[config] error listing services:", err)
+		logging.Error("error listing services", "error", err)
 	} else {
 		for _, svc := range services {
 			existingServices[svc] = struct{}{}
@@ -230,9 +512,15 @@ func Validate(state *StackState) {
 	for i := 0; i < len(state.Applications); i++ {
 		a := state.Applications[i]
 		_, foundApplication := existingApplications[a.ApplicationPath()]
-		_, foundService := existingServices[a.ServiceName()]
-		if !(foundApplication && foundService && len(a.Service.Command) > 0) {
-			log.Println("[config] removing invalid application", a.Name)
+		names := a.ServiceNames()
+		foundServices := len(names) > 0
+		for _, name := range names {
+			if _, ok := existingServices[name]; !ok {
+				foundServices = false
+			}
+		}
+		if !(foundApplication && foundServices) {
+			logging.Warn("remove invalid application", "app", a.Name)
 			copy(state.Applications[i:], state.Applications[i+1:])
 			state.Applications = state.Applications[:len(state.Applications)-1]
 			i--
@@ -240,18 +528,20 @@ func Validate(state *StackState) {
 			if foundApplication {
 				applicationsToRemove = append(applicationsToRemove, a.ApplicationPath())
 			}
-			if foundService {
-				servicesToRemove = append(servicesToRemove, a.ServiceName())
+			for _, name := range names {
+				if _, ok := existingServices[name]; ok {
+					servicesToRemove = append(servicesToRemove, name)
+				}
 			}
 		}
 	}
 
 	for _, a := range applicationsToRemove {
-		log.Println("[config] removing untracked application", a)
+		logging.Warn("remove untracked application", "path", a)
 		os.RemoveAll(a)
 	}
 	for _, s := range servicesToRemove {
-		log.Println("[config] removing untracked service", s)
+		logging.Warn("remove untracked service", "service", s)
 		serviceManager.Uninstall(s)
 	}
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/badgerodon/stack/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		limits ApplicationLimits
+		expect service.Limits
+	}{
+		{ApplicationLimits{}, service.Limits{}},
+		{ApplicationLimits{Memory: "1024"}, service.Limits{Memory: 1024}},
+		{ApplicationLimits{Memory: "512M"}, service.Limits{Memory: 512 << 20}},
+		{ApplicationLimits{Memory: "2gb"}, service.Limits{Memory: 2 << 30}},
+		{ApplicationLimits{Memory: " 1 T "}, service.Limits{Memory: 1 << 40}},
+		{ApplicationLimits{Memory: "64KB"}, service.Limits{Memory: 64 << 10}},
+		{ApplicationLimits{CPU: "50%"}, service.Limits{CPUQuota: 50}},
+		{ApplicationLimits{CPU: "150"}, service.Limits{CPUQuota: 150}},
+		{ApplicationLimits{NoFile: 4096}, service.Limits{NoFile: 4096}},
+	} {
+		limits, err := tc.limits.ServiceLimits()
+		assert.Nil(err, "%+v", tc.limits)
+		assert.Equal(tc.expect, limits, "%+v", tc.limits)
+	}
+
+	for _, invalid := range []ApplicationLimits{
+		{Memory: "lots"},
+		{Memory: "0"},
+		{Memory: "-1G"},
+		{Memory: "M"},
+		{CPU: "half"},
+		{CPU: "0%"},
+	} {
+		_, err := invalid.ServiceLimits()
+		assert.NotNil(err, "%+v", invalid)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/badgerodon/stack/logging"
+)
+
+// the control API is served over a unix socket that only the owner of the
+// stack can access. The socket is created with the umask, so it's kept in a
+// folder of its own that nobody else can enter.
+
+func controlSocketPath() string {
+	return filepath.Join(rootDir, "run", "control", "stack.sock")
+}
+
+type controlServer struct {
+	d *daemon
+}
+
+// serveControl starts serving the control API for the daemon
+func serveControl(d *daemon) (net.Listener, error) {
+	path := controlSocketPath()
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		// an existing folder keeps its permissions
+		err = os.Chmod(dir, 0700)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating control socket folder: %v", err)
+	}
+	// remove a socket left behind by a previous daemon
+	os.Remove(path)
+	li, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on control socket: %v", err)
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		li.Close()
+		return nil, err
+	}
+
+	cs := &controlServer{d: d}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apply", cs.handleApply)
+	mux.HandleFunc("/pause", cs.handlePause)
+	mux.HandleFunc("/resume", cs.handleResume)
+	mux.HandleFunc("/status", cs.handleStatus)
+	mux.HandleFunc("/services", cs.handleServices)
+	mux.HandleFunc("/error", cs.handleError)
+	mux.HandleFunc("/events", cs.handleEvents)
+	go func() {
+		err := http.Serve(li, mux)
+		if err != nil {
+			logging.Error("control api stopped", "error", err)
+		}
+	}()
+	logging.Info("control api listening", "path", path)
+	return li, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return false
+	}
+	return true
+}
+
+func (cs *controlServer) handleApply(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	err := cs.d.Apply()
+	if err != nil && err != errRestart {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+func (cs *controlServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	cs.d.Pause()
+	writeJSON(w, http.StatusOK, cs.d.Status())
+}
+
+func (cs *controlServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	cs.d.Resume()
+	writeJSON(w, http.StatusOK, cs.d.Status())
+}
+
+func (cs *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cs.d.Status())
+}
+
+// handleServices lists the services from the daemon's service manager, which
+// is the only process that can ask the local service runner
+func (cs *controlServer) handleServices(w http.ResponseWriter, r *http.Request) {
+	services, err := serviceStatuses()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, services)
+}
+
+func (cs *controlServer) handleError(w http.ResponseWriter, r *http.Request) {
+	status := cs.d.Status()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"error": status.LastError,
+		"time":  status.LastErrorTime,
+	})
+}
+
+// handleEvents streams events as newline delimited JSON
+func (cs *controlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	events, unsubscribe := cs.d.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case evt := <-events:
+			if enc.Encode(evt) != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// controlClient talks to a running daemon over the control socket
+var controlClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", controlSocketPath())
+		},
+	},
+}
+
+// daemonRunning returns true if a daemon is listening on the control socket
+func daemonRunning() bool {
+	conn, err := net.DialTimeout("unix", controlSocketPath(), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// callDaemon calls the control API, decoding the JSON response into res
+func callDaemon(method, path string, res interface{}) error {
+	req, err := http.NewRequest(method, "http://stack"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := controlClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var obj struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(bs, &obj)
+		return fmt.Errorf("daemon error: %s", obj.Error)
+	}
+	if res != nil {
+		return json.Unmarshal(bs, res)
+	}
+	return nil
+}
+
+// applyDaemon asks the running daemon to apply its config. A different
+// source can't be applied by the daemon, so it's applied directly.
+func applyDaemon(src string) error {
+	var status DaemonStatus
+	err := callDaemon("GET", "/status", &status)
+	if err != nil {
+		return err
+	}
+	if src != "" && src != status.Source {
+		return apply(src)
+	}
+	return callDaemon("POST", "/apply", nil)
+}
+
+// streamEvents prints the daemon's events until the connection is closed
+func streamEvents() error {
+	resp, err := controlClient.Get("http://stack/events")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var evt Event
+		err := dec.Decode(&evt)
+		if err != nil {
+			return err
+		}
+		line := evt.Time.Format(time.RFC3339) + " " + evt.Type
+		if evt.Message != "" {
+			line += " " + evt.Message
+		}
+		if evt.Error != "" {
+			line += " error=" + evt.Error
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,215 @@
+// Package cron parses cron expressions and computes when they next occur
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// A Field is the set of values allowed for one part of a schedule
+	Field struct {
+		bits uint64
+		any  bool
+	}
+
+	// A Schedule is a parsed cron expression
+	Schedule struct {
+		Minute, Hour, Day, Month, Weekday Field
+	}
+
+	fieldDef struct {
+		name     string
+		min, max int
+		names    []string
+	}
+)
+
+var (
+	minuteDef  = fieldDef{"minute", 0, 59, nil}
+	hourDef    = fieldDef{"hour", 0, 23, nil}
+	dayDef     = fieldDef{"day of month", 1, 31, nil}
+	monthDef   = fieldDef{"month", 1, 12, []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	weekdayDef = fieldDef{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+
+	macros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// Has returns true if the value is part of the field
+func (f Field) Has(value int) bool {
+	return f.bits&(1<<uint(value)) != 0
+}
+
+// Any returns true if the field was a wildcard
+func (f Field) Any() bool {
+	return f.any
+}
+
+// Values returns the values in the field in ascending order
+func (f Field) Values() []int {
+	var values []int
+	for i := 0; i < 64; i++ {
+		if f.Has(i) {
+			values = append(values, i)
+		}
+	}
+	return values
+}
+
+// Parse parses a standard five field cron expression (minute, hour, day of
+// month, month, day of week) or one of the @yearly, @monthly, @weekly,
+// @daily and @hourly macros
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if m, ok := macros[strings.ToLower(spec)]; ok {
+		spec = m
+	}
+
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("invalid cron expression `%s`: expected 5 fields", spec)
+	}
+
+	var s Schedule
+	var err error
+	for i, def := range []fieldDef{minuteDef, hourDef, dayDef, monthDef, weekdayDef} {
+		var f Field
+		f, err = def.parse(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression `%s`: %v", spec, err)
+		}
+		switch i {
+		case 0:
+			s.Minute = f
+		case 1:
+			s.Hour = f
+		case 2:
+			s.Day = f
+		case 3:
+			s.Month = f
+		case 4:
+			// 7 is an alias for sunday
+			if f.Has(7) {
+				f.bits = f.bits&^(1<<7) | 1
+			}
+			s.Weekday = f
+		}
+	}
+	return &s, nil
+}
+
+func (def fieldDef) value(str string) (int, error) {
+	for i, name := range def.names {
+		if name != "" && strings.EqualFold(str, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s `%s`", def.name, str)
+	}
+	if v < def.min || v > def.max {
+		return 0, fmt.Errorf("%s `%d` out of range %d-%d", def.name, v, def.min, def.max)
+	}
+	return v, nil
+}
+
+func (def fieldDef) parse(str string) (Field, error) {
+	var f Field
+	for _, part := range strings.Split(str, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return f, fmt.Errorf("invalid step `%s`", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		var lo, hi int
+		switch {
+		case part == "*":
+			lo, hi = def.min, def.max
+			if step == 1 {
+				f.any = true
+			}
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			var err error
+			lo, err = def.value(part[:i])
+			if err != nil {
+				return f, err
+			}
+			hi, err = def.value(part[i+1:])
+			if err != nil {
+				return f, err
+			}
+			if hi < lo {
+				return f, fmt.Errorf("invalid %s range `%s`", def.name, part)
+			}
+		default:
+			var err error
+			lo, err = def.value(part)
+			if err != nil {
+				return f, err
+			}
+			hi = lo
+			if step > 1 {
+				hi = def.max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			f.bits |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	day := s.Day.Has(t.Day())
+	weekday := s.Weekday.Has(int(t.Weekday()))
+	// like cron, when both fields are restricted either one may match
+	if !s.Day.any && !s.Weekday.any {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// Next returns the first time after t that matches the schedule. A zero time
+// is returned if the schedule never matches.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !s.Month.Has(int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.Hour.Has(t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.Minute.Has(t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,58 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		spec string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"*/15 0-6,22 1 jan-mar mon-fri", true},
+		{"@daily", true},
+		{"0 0 * * 7", true},
+		{"* * * *", false},
+		{"60 * * * *", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"* * * foo *", false},
+	}
+	for _, tc := range cases {
+		_, err := Parse(tc.spec)
+		if (err == nil) != tc.ok {
+			t.Errorf("for `%s` expected ok=%v, got: %v", tc.spec, tc.ok, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	from := time.Date(2018, time.March, 14, 10, 7, 30, 0, time.UTC)
+	cases := []struct {
+		spec   string
+		expect time.Time
+	}{
+		{"* * * * *", time.Date(2018, time.March, 14, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2018, time.March, 14, 10, 15, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2018, time.March, 15, 9, 0, 0, 0, time.UTC)},
+		{"30 2 1 * *", time.Date(2018, time.April, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * sun", time.Date(2018, time.March, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2018, time.March, 18, 0, 0, 0, 0, time.UTC)},
+		// either the day of month or the day of week may match
+		{"0 0 20 * fri", time.Date(2018, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, tc := range cases {
+		s, err := Parse(tc.spec)
+		if err != nil {
+			t.Fatalf("failed to parse `%s`: %v", tc.spec, err)
+		}
+		if actual := s.Next(from); !actual.Equal(tc.expect) {
+			t.Errorf("for `%s` expected %v, got %v", tc.spec, tc.expect, actual)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package cron
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Window is a recurring period of time, either a schedule with a duration
+// or a time of day range on some days of the week. Windows are evaluated in
+// their time zone.
+type Window struct {
+	spec string
+	loc  *time.Location
+
+	// schedule windows
+	schedule *Schedule
+	duration time.Duration
+
+	// range windows, in minutes since midnight. Ranges that end before they
+	// start continue past midnight.
+	days       Field
+	start, end int
+}
+
+var rangeRE = regexp.MustCompile(`^(\d{1,2}):(\d{2})-(\d{1,2}):(\d{2})$`)
+
+// ParseWindow parses a window in one of these forms:
+//
+//	[days] HH:MM-HH:MM [time zone]     ie "mon-fri 22:00-06:00 Europe/Berlin"
+//	<cron expression> <duration> [time zone]   ie "0 2 * * sat,sun 4h UTC"
+//
+// Days use the day of week syntax of cron expressions. The time zone
+// defaults to the local one.
+func ParseWindow(spec string) (*Window, error) {
+	w := &Window{spec: strings.TrimSpace(spec), loc: time.Local}
+	parts := strings.Fields(w.spec)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("invalid window: empty")
+	}
+
+	// an optional trailing time zone
+	last := parts[len(parts)-1]
+	if !rangeRE.MatchString(last) {
+		if _, err := time.ParseDuration(last); err != nil {
+			loc, err := time.LoadLocation(last)
+			if err != nil {
+				return nil, fmt.Errorf("invalid window `%s`: unknown time zone `%s`", spec, last)
+			}
+			w.loc = loc
+			parts = parts[:len(parts)-1]
+		}
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("invalid window `%s`", spec)
+	}
+
+	if m := rangeRE.FindStringSubmatch(parts[len(parts)-1]); m != nil {
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("invalid window `%s`", spec)
+		}
+		var err error
+		w.start, err = clock(m[1], m[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid window `%s`: %v", spec, err)
+		}
+		w.end, err = clock(m[3], m[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid window `%s`: %v", spec, err)
+		}
+		days := "*"
+		if len(parts) == 2 {
+			days = parts[0]
+		}
+		w.days, err = weekdayDef.parse(days)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window `%s`: %v", spec, err)
+		}
+		if w.days.Has(7) {
+			w.days.bits = w.days.bits&^(1<<7) | 1
+		}
+		return w, nil
+	}
+
+	var err error
+	w.duration, err = time.ParseDuration(parts[len(parts)-1])
+	if err != nil || w.duration <= 0 {
+		return nil, fmt.Errorf("invalid window `%s`: expected a duration after the schedule", spec)
+	}
+	w.schedule, err = Parse(strings.Join(parts[:len(parts)-1], " "))
+	if err != nil {
+		return nil, fmt.Errorf("invalid window `%s`: %v", spec, err)
+	}
+	return w, nil
+}
+
+func clock(hour, minute string) (int, error) {
+	h, _ := strconv.Atoi(hour)
+	m, _ := strconv.Atoi(minute)
+	if m > 59 || h > 24 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time `%s:%s`", hour, minute)
+	}
+	return h*60 + m, nil
+}
+
+// String returns the window as it was parsed
+func (w *Window) String() string {
+	return w.spec
+}
+
+// Contains returns true if t is inside the window
+func (w *Window) Contains(t time.Time) bool {
+	t = t.In(w.loc)
+	if w.schedule != nil {
+		// the window is open if the schedule occurred within the duration
+		next := w.schedule.Next(t.Add(-w.duration))
+		return !next.IsZero() && !next.After(t)
+	}
+
+	m := t.Hour()*60 + t.Minute()
+	today := w.days.Has(int(t.Weekday()))
+	if w.start < w.end {
+		return today && m >= w.start && m < w.end
+	}
+	if w.start == w.end {
+		return today
+	}
+	yesterday := w.days.Has(int(t.AddDate(0, 0, -1).Weekday()))
+	return (today && m >= w.start) || (yesterday && m < w.end)
+}
+
+// Next returns the time the window next opens, or t if it's open. A zero
+// time is returned if the window never opens.
+func (w *Window) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	if w.schedule != nil {
+		return w.schedule.Next(t.In(w.loc))
+	}
+	lt := t.In(w.loc)
+	for i := 0; i <= 7; i++ {
+		start := time.Date(lt.Year(), lt.Month(), lt.Day()+i, w.start/60, w.start%60, 0, 0, w.loc)
+		if w.days.Has(int(start.Weekday())) && start.After(t) {
+			return start
+		}
+	}
+	return time.Time{}
+}
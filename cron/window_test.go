@@ -0,0 +1,75 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	cases := []struct {
+		spec string
+		ok   bool
+	}{
+		{"22:00-06:00", true},
+		{"mon-fri 22:00-06:00 Europe/Berlin", true},
+		{"sat,sun 00:00-24:00", true},
+		{"0 2 * * * 2h", true},
+		{"@daily 30m UTC", true},
+		{"", false},
+		{"25:00-06:00", false},
+		{"foo 22:00-06:00", false},
+		{"22:00-06:00 Nowhere/Town", false},
+		{"0 2 * * *", false},
+		{"0 2 * * 2h", false},
+	}
+	for _, tc := range cases {
+		_, err := ParseWindow(tc.spec)
+		if (err == nil) != tc.ok {
+			t.Errorf("for `%s` expected ok=%v, got: %v", tc.spec, tc.ok, err)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+	// a wednesday
+	wed := func(hour, minute int) time.Time {
+		return time.Date(2018, time.March, 14, hour, minute, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		spec     string
+		t        time.Time
+		contains bool
+		next     time.Time
+	}{
+		{"09:00-17:00 UTC", wed(10, 0), true, wed(10, 0)},
+		{"09:00-17:00 UTC", wed(17, 0), false, wed(24+9, 0)},
+		{"22:00-06:00 UTC", wed(23, 0), true, wed(23, 0)},
+		{"22:00-06:00 UTC", wed(5, 59), true, wed(5, 59)},
+		{"22:00-06:00 UTC", wed(12, 0), false, wed(22, 0)},
+		{"tue 22:00-06:00 UTC", wed(3, 0), true, wed(3, 0)},
+		{"wed 22:00-06:00 UTC", wed(3, 0), false, wed(22, 0)},
+		{"sat,sun 00:00-24:00 UTC", wed(12, 0), false, wed(3*24, 0)},
+		// 22:00 in New York is 02:00 UTC during daylight saving time
+		{"22:00-23:00 America/New_York", wed(2, 30), true, wed(2, 30)},
+		{"22:00-23:00 America/New_York", wed(12, 0), false, time.Date(2018, time.March, 14, 22, 0, 0, 0, ny)},
+		{"0 2 * * * 2h UTC", wed(3, 59), true, wed(3, 59)},
+		{"0 2 * * * 2h UTC", wed(4, 0), false, wed(24+2, 0)},
+		{"0 2 * * * 2h UTC", wed(1, 0), false, wed(2, 0)},
+	}
+	for _, tc := range cases {
+		w, err := ParseWindow(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Contains(tc.t); got != tc.contains {
+			t.Errorf("expected `%s` contains %v to be %v", tc.spec, tc.t, tc.contains)
+		}
+		if got := w.Next(tc.t); !got.Equal(tc.next) {
+			t.Errorf("expected `%s` after %v to open at %v, got %v", tc.spec, tc.t, tc.next, got)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badgerodon/stack/logging"
+	stacksync "github.com/badgerodon/stack/sync"
+	"github.com/cenkalti/backoff"
+)
+
+type (
+	// An Event is something that happened in the stack daemon
+	Event struct {
+		Time    time.Time `json:"time"`
+		Type    string    `json:"type"`
+		Message string    `json:"message,omitempty"`
+		Error   string    `json:"error,omitempty"`
+	}
+
+	// DaemonStatus is the current state of the stack daemon
+	DaemonStatus struct {
+		Source       string    `json:"source"`
+		Version      string    `json:"version,omitempty"`
+		Paused       bool      `json:"paused"`
+		Pending      bool      `json:"pending"`
+		PendingSince time.Time `json:"pending_since,omitempty"`
+		// Changes describe what applying the pending version would change
+		Changes []string `json:"changes,omitempty"`
+		// NextWindow is when the next maintenance window opens, if the
+		// pending version is waiting for one
+		NextWindow    time.Time    `json:"next_window,omitempty"`
+		Applying      bool         `json:"applying"`
+		LastApply     time.Time    `json:"last_apply,omitempty"`
+		LastError     string       `json:"last_error,omitempty"`
+		LastErrorTime time.Time    `json:"last_error_time,omitempty"`
+		Retry         *RetryStatus `json:"retry,omitempty"`
+	}
+
+	// a sourceWatcher watches the source of an application
+	sourceWatcher struct {
+		watcher *stacksync.Watcher
+		stop    chan struct{}
+	}
+
+	// RetryStatus is the state of the retries of a failed apply
+	RetryStatus struct {
+		Version   string    `json:"version"`
+		Attempts  int       `json:"attempts"`
+		NextRetry time.Time `json:"next_retry,omitempty"`
+		LastError string    `json:"last_error"`
+		// GaveUp is true when no more retries will be made for the version
+		GaveUp bool `json:"gave_up,omitempty"`
+	}
+
+	// A daemon is the long running `watch` process
+	daemon struct {
+		src      string
+		requests chan chan error
+		wake     chan struct{}
+		// watcher is updated with the poll options in the config, with
+		// pollOptions from the command line taking precedence
+		watcher     *stacksync.Watcher
+		pollOptions stacksync.Options
+		// sources are the watchers of applications with `watch: true`
+		sources       map[string]*sourceWatcher
+		sourceChanged chan string
+
+		mu            sync.Mutex
+		status        DaemonStatus
+		subscribers   map[chan Event]struct{}
+		notifications []Notification
+		// config is the last config that was read, used to check rollouts
+		config *Config
+		// maintenance windows from the command line replace the ones in the
+		// config
+		maintenance []MaintenanceWindow
+	}
+)
+
+// a service that restarts crashLoopRestarts times within crashLoopWindow is
+// in a crash loop
+const (
+	crashLoopRestarts = 3
+	crashLoopWindow   = time.Minute * 5
+	crashLoopInterval = time.Second * 30
+)
+
+func newDaemon(src string) *daemon {
+	return &daemon{
+		src:         src,
+		requests:    make(chan chan error),
+		wake:        make(chan struct{}, 1),
+		status:      DaemonStatus{Source: src},
+		subscribers: map[chan Event]struct{}{},
+
+		sources:       map[string]*sourceWatcher{},
+		sourceChanged: make(chan string),
+	}
+}
+
+// Status returns the current status of the daemon
+func (d *daemon) Status() DaemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := d.status
+	if status.Retry != nil {
+		retry := *status.Retry
+		status.Retry = &retry
+	}
+	return status
+}
+
+// retryFailed records a failed attempt to apply the current version. next is
+// the time until the next attempt, or backoff.Stop if there won't be one.
+func (d *daemon) retryFailed(err error, next time.Duration) {
+	d.mu.Lock()
+	retry := d.status.Retry
+	if retry == nil || retry.Version != d.status.Version {
+		retry = &RetryStatus{Version: d.status.Version}
+		d.status.Retry = retry
+	}
+	retry.Attempts++
+	retry.LastError = err.Error()
+	if next == backoff.Stop {
+		retry.GaveUp = true
+		retry.NextRetry = time.Time{}
+	} else {
+		retry.NextRetry = time.Now().Add(next)
+	}
+	r := *retry
+	d.mu.Unlock()
+
+	if r.GaveUp {
+		logging.Error("apply failed, giving up until the next version", "version", r.Version, "attempts", r.Attempts)
+		d.publish(Event{Type: "retry-gave-up", Message: r.Version, Error: r.LastError})
+	} else {
+		logging.Warn("apply failed, retrying", "version", r.Version, "attempts", r.Attempts, "retry_in", next)
+		d.publish(Event{Type: "retry-scheduled", Message: fmt.Sprintf("%s attempt %d, retry in %v", r.Version, r.Attempts, next), Error: r.LastError})
+	}
+}
+
+// clearRetry forgets the retries of the previous version
+func (d *daemon) clearRetry() {
+	d.mu.Lock()
+	retry := d.status.Retry
+	d.status.Retry = nil
+	d.mu.Unlock()
+	if retry != nil && !retry.GaveUp && retry.Version != d.Status().Version {
+		logging.Info("cancel retries", "version", retry.Version, "attempts", retry.Attempts)
+	}
+}
+
+// publish sends an event to every subscriber. Slow subscribers miss events
+// rather than block the daemon.
+func (d *daemon) publish(evt Event) {
+	evt.Time = time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for c := range d.subscribers {
+		select {
+		case c <- evt:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a function to stop receiving them
+func (d *daemon) Subscribe() (<-chan Event, func()) {
+	c := make(chan Event, 100)
+	d.mu.Lock()
+	d.subscribers[c] = struct{}{}
+	d.mu.Unlock()
+	return c, func() {
+		d.mu.Lock()
+		delete(d.subscribers, c)
+		d.mu.Unlock()
+	}
+}
+
+// Apply asks the daemon to apply the config now, even if it's paused
+func (d *daemon) Apply() error {
+	result := make(chan error, 1)
+	d.requests <- result
+	return <-result
+}
+
+// Pause stops applying new versions until Resume is called
+func (d *daemon) Pause() {
+	d.mu.Lock()
+	d.status.Paused = true
+	d.mu.Unlock()
+	logging.Info("paused")
+	d.publish(Event{Type: "paused"})
+}
+
+// Resume starts applying new versions again, including any that were
+// detected while paused
+func (d *daemon) Resume() {
+	d.mu.Lock()
+	d.status.Paused = false
+	pending := d.status.Pending
+	d.mu.Unlock()
+	logging.Info("resumed")
+	d.publish(Event{Type: "resumed"})
+	if pending {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// maintenanceOpen returns true if new versions may be applied now, and
+// otherwise when the next maintenance window opens
+func (d *daemon) maintenanceOpen() (bool, time.Time) {
+	d.mu.Lock()
+	windows, cfg := d.maintenance, d.config
+	d.mu.Unlock()
+	if len(windows) == 0 {
+		// before the first apply the windows are read from the config
+		if cfg == nil {
+			cfg, _ = readConfig(d.src)
+		}
+		if cfg != nil {
+			windows = cfg.Maintenance
+		}
+	}
+	return maintenanceOpen(windows, time.Now())
+}
+
+// deferApply records a new version and marks it as pending if the daemon is
+// paused or outside of a maintenance window. changed are the applications
+// with new source versions.
+func (d *daemon) deferApply(version string, changed ...string) bool {
+	d.mu.Lock()
+	d.status.Version = version
+	paused := d.status.Paused
+	d.mu.Unlock()
+
+	var next time.Time
+	if !paused {
+		var open bool
+		open, next = d.maintenanceOpen()
+		if open {
+			return false
+		}
+	}
+
+	var changes []string
+	if cfg, err := readConfig(d.src); err == nil {
+		changes = pendingChanges(LoadStackState(), cfg)
+	}
+
+	d.mu.Lock()
+	queued := !d.status.Pending
+	d.status.Pending = true
+	if queued {
+		d.status.PendingSince = time.Now()
+	}
+	d.status.NextWindow = next
+	// new source versions only show up when applying, so remember them
+	for _, name := range changed {
+		changed := "update " + name
+		if !containsString(changes, changed) {
+			changes = append(changes, changed)
+		}
+	}
+	for _, change := range d.status.Changes {
+		if strings.HasPrefix(change, "update ") && !containsString(changes, change) {
+			changes = append(changes, change)
+		}
+	}
+	d.status.Changes = changes
+	d.mu.Unlock()
+
+	if !paused && queued {
+		logging.Info("outside of maintenance window, queued", "version", version, "next_window", next)
+		d.publish(Event{Type: "queued", Message: fmt.Sprintf("%s until %s", version, next.Format(time.RFC3339))})
+	}
+	return true
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies the config and updates the stack binary. errRestart is
+// returned if the binary was replaced.
+func (d *daemon) apply() error {
+	d.mu.Lock()
+	d.status.Applying = true
+	d.status.Pending = false
+	d.status.PendingSince = time.Time{}
+	d.status.NextWindow = time.Time{}
+	d.status.Changes = nil
+	d.mu.Unlock()
+	d.publish(Event{Type: "apply-started", Message: d.src})
+	start := time.Now()
+
+	cfg, err := readConfig(d.src)
+	if err == nil {
+		if d.watcher != nil {
+			d.watcher.SetOptions(d.pollOptions.Merge(cfg.Watch))
+		}
+		err = applyConfig(cfg)
+	}
+
+	d.mu.Lock()
+	if cfg != nil {
+		d.notifications = cfg.Notifications
+		d.config = cfg
+	}
+	notifications := d.notifications
+	d.status.Applying = false
+	if err == nil {
+		d.status.LastApply = time.Now()
+		confirmSelfUpdate()
+	} else {
+		d.status.LastError = err.Error()
+		d.status.LastErrorTime = time.Now()
+	}
+	d.mu.Unlock()
+
+	if err != nil {
+		logging.Error("apply failed", "app", errorDetails(err).application, "stage", errorDetails(err).stage, "duration", time.Since(start), "error", err)
+		d.publish(Event{Type: "apply-failed", Error: err.Error()})
+	} else {
+		logging.Info("apply succeeded", "location", d.src, "duration", time.Since(start))
+		d.publish(Event{Type: "apply-succeeded"})
+	}
+	notifyApply(notifications, err)
+
+	if cfg != nil {
+		d.watchSources(cfg)
+		reportRollouts(cfg)
+
+		updated, uerr := selfUpdate(d.src, cfg)
+		if uerr != nil {
+			logging.Error("self-update failed", "error", uerr)
+			d.publish(Event{Type: "self-update-failed", Error: uerr.Error()})
+			notifyApply(notifications, uerr)
+		} else if updated {
+			logging.Info("stack updated, restarting")
+			d.publish(Event{Type: "self-update-succeeded"})
+			waitNotifications()
+			return errRestart
+		}
+	}
+
+	return err
+}
+
+// checkRollouts publishes the health of applications with a rollout policy
+// and returns true if a held back version can now roll out to this host
+func (d *daemon) checkRollouts() bool {
+	d.mu.Lock()
+	cfg := d.config
+	d.mu.Unlock()
+	if cfg == nil {
+		return false
+	}
+	reportRollouts(cfg)
+	return rolloutsReady(LoadStackState(), cfg)
+}
+
+// monitorServices watches the restart counts of services and reports
+// services in a crash loop
+func (d *daemon) monitorServices(done <-chan struct{}) {
+	type sample struct {
+		time     time.Time
+		restarts int
+	}
+	history := map[string][]sample{}
+	looping := map[string]bool{}
+
+	ticker := time.NewTicker(crashLoopInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		names, err := serviceManager.List()
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		seen := map[string]bool{}
+		for _, name := range names {
+			st, err := serviceManager.Status(name)
+			if err != nil {
+				continue
+			}
+			seen[name] = true
+
+			h := append(history[name], sample{now, st.Restarts})
+			for now.Sub(h[0].time) > crashLoopWindow {
+				h = h[1:]
+			}
+			history[name] = h
+
+			restarts := st.Restarts - h[0].restarts
+			if restarts >= crashLoopRestarts && !looping[name] {
+				looping[name] = true
+				msg := fmt.Sprintf("%d restarts in %v", restarts, crashLoopWindow)
+				logging.Warn("crash loop", "app", serviceApplication(name), "service", name, "restarts", restarts)
+				d.publish(Event{Type: "crash-loop", Message: name + ": " + msg})
+				d.mu.Lock()
+				notifications := d.notifications
+				d.mu.Unlock()
+				notify(notifications, NotificationEvent{
+					Event:       notifyCrashLoop,
+					Application: serviceApplication(name),
+					Service:     name,
+					Message:     msg,
+				})
+			} else if restarts <= 0 {
+				looping[name] = false
+			}
+		}
+		for name := range history {
+			if !seen[name] {
+				delete(history, name)
+				delete(looping, name)
+			}
+		}
+	}
+}
+
+// serviceApplication returns the name of the application a service belongs
+// to
+func serviceApplication(service string) string {
+	for _, app := range LoadStackState().Applications {
+		for _, name := range app.ServiceNames() {
+			if name == service {
+				return app.Name
+			}
+		}
+	}
+	return ""
+}
+
+// watchSources starts watching the sources of applications with
+// `watch: true` and stops watching the ones that were removed
+func (d *daemon) watchSources(cfg *Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	opts := d.pollOptions.Merge(cfg.Watch)
+	seen := map[string]bool{}
+	for _, app := range cfg.Applications {
+		if !app.Watch {
+			continue
+		}
+		key := app.Name + ":" + app.SourceHash()
+		seen[key] = true
+		if _, ok := d.sources[key]; ok {
+			continue
+		}
+		w, err := stacksync.Watch(app.Source, opts)
+		if err != nil {
+			logging.Error("error watching source", "app", app.Name, "location", app.Source, "error", err)
+			continue
+		}
+		sw := &sourceWatcher{watcher: w, stop: make(chan struct{})}
+		d.sources[key] = sw
+		go d.forwardSource(app.Name, sw)
+	}
+	for key, sw := range d.sources {
+		if !seen[key] {
+			sw.watcher.Stop()
+			close(sw.stop)
+			delete(d.sources, key)
+		}
+	}
+}
+
+// stopSources stops watching every application source
+func (d *daemon) stopSources() {
+	d.watchSources(&Config{})
+}
+
+// forwardSource reports new versions of an application's source to the
+// watch loop
+func (d *daemon) forwardSource(name string, sw *sourceWatcher) {
+	// the watcher starts with the current version, which was just applied
+	first := true
+	for {
+		select {
+		case version := <-sw.watcher.C:
+			if first {
+				first = false
+				continue
+			}
+			logging.Info("new source version", "app", name, "version", version)
+			d.publish(Event{Type: "new-source-version", Message: name + " " + version})
+			select {
+			case d.sourceChanged <- name:
+			case <-sw.stop:
+				return
+			}
+		case <-sw.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/badgerodon/stack/storage"
+)
+
+// defaultPath is used when a service's environment doesn't include a PATH. It
+// matches the default used by systemd.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+type (
+	// EnvFiles are files of KEY=VALUE lines. Local paths are relative to the
+	// application's directory, any other location is downloaded.
+	EnvFiles []storage.Location
+
+	// An InheritPolicy controls which of the stack's own environment
+	// variables are passed to a service: `none` (the default), `all` or a
+	// list of variable names
+	InheritPolicy struct {
+		Mode  string
+		Names []string
+	}
+)
+
+// UnmarshalYAML unmarshals a yaml structure
+func (ef *EnvFiles) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []storage.Location
+	err := unmarshal(&list)
+	if err == nil {
+		*ef = list
+		return nil
+	}
+	var single storage.Location
+	err = unmarshal(&single)
+	if err != nil {
+		return err
+	}
+	*ef = EnvFiles{single}
+	return nil
+}
+
+// UnmarshalYAML unmarshals a yaml structure
+func (ip *InheritPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var names []string
+	err := unmarshal(&names)
+	if err == nil {
+		ip.Mode = "list"
+		ip.Names = names
+		return nil
+	}
+	var mode string
+	err = unmarshal(&mode)
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case "none", "all":
+		ip.Mode = mode
+		return nil
+	}
+	return fmt.Errorf("invalid inherit_env: %s, expected none, all or a list", mode)
+}
+
+// Environment returns the variables inherited from the stack's environment
+func (ip InheritPolicy) Environment() map[string]string {
+	env := map[string]string{}
+	switch ip.Mode {
+	case "all":
+		for _, e := range os.Environ() {
+			if i := strings.IndexByte(e, '='); i > 0 {
+				env[e[:i]] = e[i+1:]
+			}
+		}
+	case "list":
+		for _, name := range ip.Names {
+			if v, ok := os.LookupEnv(name); ok {
+				env[name] = v
+			}
+		}
+	}
+	return env
+}
+
+// stackEnvironmentNames and stackEnvironmentPrefixes are the variables the
+// stack service keeps from the environment it's installed from: the basics a
+// process needs and the settings and credentials of the storage providers
+var (
+	stackEnvironmentNames = []string{
+		"HOME", "USER", "PATH", "TMPDIR", "SystemRoot", "USERPROFILE", "TEMP",
+		"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	}
+	stackEnvironmentPrefixes = []string{
+		"AWS_", "AZURE_", "GCLOUD_", "GOOGLE_", "FTP_", "SSH_", "COPY_", "MEGA_",
+	}
+)
+
+// stackEnvironment returns the variables of the current environment to
+// install the stack service with
+func stackEnvironment() map[string]string {
+	env := InheritPolicy{Mode: "list", Names: stackEnvironmentNames}.Environment()
+	for _, e := range os.Environ() {
+		i := strings.IndexByte(e, '=')
+		if i <= 0 {
+			continue
+		}
+		for _, prefix := range stackEnvironmentPrefixes {
+			if strings.HasPrefix(e[:i], prefix) {
+				env[e[:i]] = e[i+1:]
+			}
+		}
+	}
+	return env
+}
+
+// parseEnvFile parses lines of KEY=VALUE. Blank lines, comments and a
+// leading `export` are ignored and values may be quoted.
+func parseEnvFile(rdr io.Reader, env map[string]string) error {
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return fmt.Errorf("invalid line: %s", line)
+		}
+		k, v := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		env[k] = v
+	}
+	return scanner.Err()
+}
+
+// readEnvFiles reads env files into env, later files taking precedence
+func readEnvFiles(dir string, files EnvFiles, env map[string]string) error {
+	for _, loc := range files {
+		if loc.Type() == "local" && !filepath.IsAbs(loc.Path()) {
+			dup := storage.Location{}
+			for k, v := range loc {
+				dup[k] = v
+			}
+			dup["path"] = filepath.Join(dir, loc.Path())
+			loc = dup
+		}
+
+		rc, err := storage.Get(loc)
+		if err != nil {
+			return fmt.Errorf("error reading env file %s: %v", loc.Path(), err)
+		}
+		err = parseEnvFile(rc, env)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("error reading env file %s: %v", loc.Path(), err)
+		}
+	}
+	return nil
+}
+
+// environment builds the complete environment of a service. In order of
+// precedence it is made up of the service's own environment, the extra
+// variables provided by the stack, env files and inherited variables.
+// Overrides (ie a process of the service) are layered on top.
+func (as ApplicationService) environment(dir string, extra map[string]string, overrides ...ApplicationService) (map[string]string, error) {
+	policy := as.InheritEnv
+	files := append(EnvFiles{}, as.EnvFiles...)
+	for _, o := range overrides {
+		if o.InheritEnv.Mode != "" {
+			policy = o.InheritEnv
+		}
+		files = append(files, o.EnvFiles...)
+	}
+
+	env := policy.Environment()
+	err := readEnvFiles(dir, files, env)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		env[k] = v
+	}
+	for k, v := range as.Environment {
+		env[k] = v
+	}
+	for _, o := range overrides {
+		for k, v := range o.Environment {
+			env[k] = v
+		}
+	}
+	if _, ok := env["PATH"]; !ok && runtime.GOOS != "windows" {
+		env["PATH"] = defaultPath
+	}
+	return env, nil
+}
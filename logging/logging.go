@@ -0,0 +1,285 @@
+// Package logging writes structured, leveled log records in the logfmt or
+// JSON format.
+//
+// Records have a message and a list of alternating keys and values:
+//
+//	logging.Info("download", "app", app.Name, "location", app.Source)
+//
+// Values of keys that look like secrets, and passwords or tokens embedded in
+// URLs, are redacted.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// A Level is the severity of a log record
+	Level int
+
+	// A Logger writes records with a set of fields
+	Logger struct {
+		fields []interface{}
+	}
+)
+
+// levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// formats
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// Redacted replaces secrets
+const Redacted = "REDACTED"
+
+var (
+	mu     sync.Mutex
+	out    io.Writer = os.Stderr
+	format           = FormatLogfmt
+	level            = LevelInfo
+
+	std = &Logger{}
+
+	secretKeys = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential|authorization|signature|private|key$)`)
+	// user:password@ in URLs
+	secretUserinfo = regexp.MustCompile(`(://[^/:@\s]*:)[^/@\s]+@`)
+	// secret=value in query strings and environment variables
+	secretParams = regexp.MustCompile(`(?i)((?:password|passwd|secret|token|credential|signature|sig|access_key|secret_key|api_key|apikey)[a-z_]*=)[^&\s"]+`)
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel parses a level name
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %s", name)
+}
+
+// SetLevel sets the minimum level that is written
+func SetLevel(l Level) {
+	mu.Lock()
+	level = l
+	mu.Unlock()
+}
+
+// SetFormat sets the output format, either logfmt or json
+func SetFormat(f string) error {
+	switch f {
+	case FormatLogfmt, FormatJSON:
+	case "":
+		f = FormatLogfmt
+	default:
+		return fmt.Errorf("unknown log format: %s", f)
+	}
+	mu.Lock()
+	format = f
+	mu.Unlock()
+	return nil
+}
+
+// SetOutput sets the destination of log records
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	out = w
+	mu.Unlock()
+}
+
+// Redact removes secrets embedded in a string
+func Redact(s string) string {
+	s = secretUserinfo.ReplaceAllString(s, "${1}"+Redacted+"@")
+	return secretParams.ReplaceAllString(s, "${1}"+Redacted)
+}
+
+// With returns a logger that adds the given fields to every record
+func With(keyvals ...interface{}) *Logger {
+	return std.With(keyvals...)
+}
+
+// Debug writes a debug record
+func Debug(msg string, keyvals ...interface{}) { std.log(LevelDebug, msg, keyvals) }
+
+// Info writes an info record
+func Info(msg string, keyvals ...interface{}) { std.log(LevelInfo, msg, keyvals) }
+
+// Warn writes a warning record
+func Warn(msg string, keyvals ...interface{}) { std.log(LevelWarn, msg, keyvals) }
+
+// Error writes an error record
+func Error(msg string, keyvals ...interface{}) { std.log(LevelError, msg, keyvals) }
+
+// With returns a logger that adds the given fields to every record
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{fields: fields}
+}
+
+// Debug writes a debug record
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+
+// Info writes an info record
+func (l *Logger) Info(msg string, keyvals ...interface{}) { l.log(LevelInfo, msg, keyvals) }
+
+// Warn writes a warning record
+func (l *Logger) Warn(msg string, keyvals ...interface{}) { l.log(LevelWarn, msg, keyvals) }
+
+// Error writes an error record
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+type field struct {
+	key   string
+	value string
+}
+
+func (l *Logger) log(lvl Level, msg string, keyvals []interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if lvl < level {
+		return
+	}
+
+	fields := []field{
+		{"time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")},
+		{"level", lvl.String()},
+		{"msg", Redact(msg)},
+	}
+	all := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		var value interface{} = "MISSING"
+		if i+1 < len(all) {
+			value = all[i+1]
+		}
+		fields = append(fields, field{key, formatValue(key, value)})
+	}
+
+	if format == FormatJSON {
+		writeJSON(out, fields)
+	} else {
+		writeLogfmt(out, fields)
+	}
+}
+
+func formatValue(key string, value interface{}) string {
+	if secretKeys.MatchString(key) {
+		return Redacted
+	}
+
+	var s string
+	switch v := value.(type) {
+	case nil:
+		s = ""
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case time.Duration:
+		s = v.String()
+	case time.Time:
+		s = v.Format(time.RFC3339)
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		rv := reflect.ValueOf(value)
+		if rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String {
+			s = formatMap(rv)
+		} else {
+			s = fmt.Sprint(value)
+		}
+	}
+	return Redact(s)
+}
+
+// formatMap formats a map as space separated key=value pairs, redacting
+// secret keys
+func formatMap(rv reflect.Value) string {
+	var keys []string
+	for _, k := range rv.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		v := fmt.Sprint(rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key())).Interface())
+		if secretKeys.MatchString(k) {
+			v = Redacted
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, " ")
+}
+
+func writeLogfmt(w io.Writer, fields []field) {
+	var buf []byte
+	for i, f := range fields {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, f.key...)
+		buf = append(buf, '=')
+		if f.value == "" || strings.ContainsAny(f.value, " =\"\t\r\n\\") {
+			buf = strconv.AppendQuote(buf, f.value)
+		} else {
+			buf = append(buf, f.value...)
+		}
+	}
+	buf = append(buf, '\n')
+	w.Write(buf)
+}
+
+func writeJSON(w io.Writer, fields []field) {
+	var buf []byte
+	buf = append(buf, '{')
+	for i, f := range fields {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		k, _ := json.Marshal(f.key)
+		v, _ := json.Marshal(f.value)
+		buf = append(buf, k...)
+		buf = append(buf, ':')
+		buf = append(buf, v...)
+	}
+	buf = append(buf, '}', '\n')
+	w.Write(buf)
+}
@@ -3,14 +3,17 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/badgerodon/stack/logging"
 	"github.com/badgerodon/stack/service"
 	"github.com/badgerodon/stack/service/runner"
 	"github.com/badgerodon/stack/storage"
+	"github.com/badgerodon/stack/sync"
 	"github.com/codegangsta/cli"
 	"github.com/kardianos/osext"
 )
@@ -80,6 +83,32 @@ func rm(src string) error {
 	return storage.Delete(loc)
 }
 
+func syncDirs(src, dst string, opts sync.DirOptions) error {
+	snl, err := storage.ParseLocation(src)
+	if err != nil {
+		return err
+	}
+	dnl, err := storage.ParseLocation(dst)
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if opts.DryRun {
+		prefix = "(dry run) "
+	}
+	opts.Progress = func(c sync.Change) {
+		if c.Err != nil {
+			fmt.Printf("%s%s %s: %v\n", prefix, c.Op, c.Path, c.Err)
+		} else {
+			fmt.Printf("%s%s %s\n", prefix, c.Op, c.Path)
+		}
+	}
+	res, err := sync.Dir(snl, dnl, opts)
+	fmt.Printf("%scopied %d, deleted %d, unchanged %d\n", prefix, res.Copied, res.Deleted, res.Unchanged)
+	return err
+}
+
 func main() {
 	log.SetFlags(0)
 
@@ -89,12 +118,46 @@ func main() {
 	app.Version = "0.6"
 	app.Author = "Caleb Doxsey"
 	app.Email = "caleb@doxsey.net"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  logging.FormatLogfmt,
+			Usage:  "log format: logfmt or json",
+			EnvVar: "STACK_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "info",
+			Usage:  "minimum log level: debug, info, warn or error",
+			EnvVar: "STACK_LOG_LEVEL",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		err := logging.SetFormat(c.GlobalString("log-format"))
+		if err != nil {
+			return err
+		}
+		level, err := logging.ParseLevel(c.GlobalString("log-level"))
+		if err != nil {
+			return err
+		}
+		logging.SetLevel(level)
+		// pass the settings on to the service runner
+		os.Setenv("STACK_LOG_FORMAT", c.GlobalString("log-format"))
+		os.Setenv("STACK_LOG_LEVEL", c.GlobalString("log-level"))
+		return nil
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:  "apply",
 			Usage: "apply the configuration file",
 			Action: func(c *cli.Context) {
-				err := apply(c.Args().First())
+				var err error
+				if daemonRunning() {
+					err = applyDaemon(c.Args().First())
+				} else {
+					err = apply(c.Args().First())
+				}
 				if err != nil {
 					log.Fatalln(err)
 				}
@@ -139,15 +202,53 @@ func main() {
 				}
 			},
 		},
+		{
+			Name:  "events",
+			Usage: "stream events from the running stack daemon",
+			Action: func(c *cli.Context) {
+				err := streamEvents()
+				if err != nil {
+					log.Fatalln(err)
+				}
+			},
+		},
 		{
 			Name:  "install",
 			Usage: "install the stack as a service: install",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "metrics-addr",
+					Usage: "address for the stack service to serve prometheus metrics on",
+				},
+				cli.StringFlag{
+					Name:  "webhook-addr",
+					Usage: "address for the stack service to listen for push webhooks on",
+				},
+				cli.StringFlag{
+					Name:   "webhook-secret",
+					Usage:  "secret used to sign webhooks",
+					EnvVar: "STACK_WEBHOOK_SECRET",
+				},
+				cli.DurationFlag{
+					Name:  "poll-interval",
+					Usage: "time between checks for a new version",
+				},
+				cli.DurationFlag{
+					Name:  "poll-jitter",
+					Usage: "maximum random time added to the poll interval",
+				},
+				cli.StringFlag{
+					Name:   "maintenance",
+					Usage:  "maintenance windows for the stack service, separated by semicolons",
+					EnvVar: "STACK_MAINTENANCE",
+				},
+			},
 			Action: func(c *cli.Context) {
 				if len(c.Args()) < 1 {
 					log.Fatalln("config file location is required")
 				}
 
-				log.Println("installing using", serviceManager)
+				logging.Info("install stack", "manager", serviceManager)
 
 				// uninstall any existing stack service
 				serviceManager.Uninstall("stack")
@@ -159,7 +260,7 @@ func main() {
 
 				dstName := filepath.Join(rootDir, "stack")
 
-				log.Println("copying", exeName, "to", dstName)
+				logging.Info("copy stack", "from", exeName, "path", dstName)
 
 				os.MkdirAll(rootDir, 0755)
 				src, err := os.Open(exeName)
@@ -175,11 +276,54 @@ func main() {
 				io.Copy(dst, src)
 				dst.Close()
 
+				command := []string{filepath.Join(rootDir, "stack"), "watch"}
+				if c.String("metrics-addr") != "" {
+					command = append(command, "--metrics-addr", c.String("metrics-addr"))
+				}
+				for _, name := range []string{"poll-interval", "poll-jitter"} {
+					if c.Duration(name) > 0 {
+						command = append(command, "--"+name, c.Duration(name).String())
+					}
+				}
+				// service managers start the service with an empty environment,
+				// which would lose HOME and the storage credentials
+				environment := stackEnvironment()
+				environment["STACK_LOG_FORMAT"] = c.GlobalString("log-format")
+				environment["STACK_LOG_LEVEL"] = c.GlobalString("log-level")
+				if c.String("maintenance") != "" {
+					if _, err := parseMaintenanceWindows(c.String("maintenance")); err != nil {
+						log.Fatalln(err)
+					}
+					// windows contain spaces, which the service command can't
+					environment["STACK_MAINTENANCE"] = c.String("maintenance")
+				}
+				if c.String("webhook-addr") != "" {
+					command = append(command, "--webhook-addr", c.String("webhook-addr"))
+					// unit files and the process list are readable by every user,
+					// so only the path of the secret is passed
+					if c.String("webhook-secret") != "" {
+						secretPath := filepath.Join(rootDir, "webhook-secret")
+						err = ioutil.WriteFile(secretPath, []byte(c.String("webhook-secret")), 0600)
+						if err == nil {
+							// an existing file keeps its permissions
+							err = os.Chmod(secretPath, 0600)
+						}
+						if err != nil {
+							log.Fatalln(err)
+						}
+						command = append(command, "--webhook-secret-file", secretPath)
+					}
+				}
+				command = append(command, c.Args().First())
+
 				err = serviceManager.Install(service.Service{
 					Name:        "stack",
 					Directory:   rootDir,
-					Command:     []string{filepath.Join(rootDir, "stack"), "watch", c.Args().First()},
-					Environment: map[string]string{},
+					Command:     command,
+					Environment: environment,
+					// the service runner creates the cgroups for application
+					// limits below the stack's
+					Delegate: true,
 				})
 				if err != nil {
 					log.Fatalln(err)
@@ -196,6 +340,26 @@ func main() {
 				}
 			},
 		},
+		{
+			Name:  "pause",
+			Usage: "stop the running stack daemon from applying new versions",
+			Action: func(c *cli.Context) {
+				err := callDaemon("POST", "/pause", nil)
+				if err != nil {
+					log.Fatalln(err)
+				}
+			},
+		},
+		{
+			Name:  "resume",
+			Usage: "resume applying new versions, including any detected while paused",
+			Action: func(c *cli.Context) {
+				err := callDaemon("POST", "/resume", nil)
+				if err != nil {
+					log.Fatalln(err)
+				}
+			},
+		},
 		{
 			Name:  "rm",
 			Usage: "remove a file",
@@ -206,6 +370,55 @@ func main() {
 				}
 			},
 		},
+		{
+			Name:  "run-scheduled",
+			Usage: "run a command on a schedule, used by service managers without scheduling: run-scheduled -- <command>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "name of the service",
+				},
+				cli.StringFlag{
+					Name:  "schedule",
+					Usage: "cron expression",
+				},
+				cli.StringFlag{
+					Name:  "status-file",
+					Usage: "file to store status in",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) < 1 {
+					log.Fatalln("command is required")
+				}
+
+				dir, err := os.Getwd()
+				if err != nil {
+					log.Fatalln(err)
+				}
+
+				err = runner.RunScheduled(runner.Service{
+					Name:      c.String("name"),
+					Directory: dir,
+					Command:   c.Args(),
+					Schedule:  c.String("schedule"),
+				}, c.String("status-file"))
+				if err != nil {
+					log.Fatalln(err)
+				}
+			},
+		},
+		{
+			Name:   "self-test",
+			Usage:  "check that the stack binary works on this host: self-test [config]",
+			Hidden: true,
+			Action: func(c *cli.Context) {
+				err := runSelfTest(os.Stdout, c.Args().First())
+				if err != nil {
+					log.Fatalln(err)
+				}
+			},
+		},
 		{
 			Name:  "service-runner",
 			Usage: "daemon started by `watch` that runs applications",
@@ -223,16 +436,145 @@ func main() {
 				runner.Run(c.String("address"), c.String("state-file"))
 			},
 		},
+		{
+			Name:  "status",
+			Usage: "show the status of installed services",
+			Action: func(c *cli.Context) {
+				err := status()
+				if err != nil {
+					log.Fatalln(err)
+				}
+			},
+		},
+		{
+			Name:  "sync",
+			Usage: "copy the changed files in a folder and its sub-folders: sync <source> <dest>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "delete",
+					Usage: "delete files in the destination that aren't in the source",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "allow --delete to empty the destination when the source is empty",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "show what would change without changing anything",
+				},
+				cli.IntFlag{
+					Name:  "parallel",
+					Value: sync.DefaultParallel,
+					Usage: "number of concurrent transfers",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) < 2 {
+					log.Fatalln("source and destination arguments are required")
+				}
+
+				err := syncDirs(c.Args()[0], c.Args()[1], sync.DirOptions{
+					Delete:   c.Bool("delete"),
+					Force:    c.Bool("force"),
+					DryRun:   c.Bool("dry-run"),
+					Parallel: c.Int("parallel"),
+				})
+				if err != nil {
+					log.Fatalln(err)
+				}
+			},
+		},
+		{
+			Name:  "uninstall",
+			Usage: "uninstall the stack service and every application it manages",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "keep-data",
+					Usage: "leave the extracted applications on disk",
+				},
+				cli.BoolFlag{
+					Name:  "watcher-only",
+					Usage: "only remove the stack service, leaving applications running",
+				},
+			},
+			Action: func(c *cli.Context) {
+				err := uninstall(c.Bool("keep-data"), c.Bool("watcher-only"))
+				if err != nil {
+					log.Fatalln(err)
+				}
+			},
+		},
 		{
 			Name:  "watch",
 			Usage: "watch a config file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "metrics-addr",
+					Usage: "address to serve prometheus metrics on, e.g. :9100",
+				},
+				cli.StringFlag{
+					Name:  "webhook-addr",
+					Usage: "address to listen for push webhooks on, e.g. :9200",
+				},
+				cli.StringFlag{
+					Name:   "webhook-secret",
+					Usage:  "secret used to sign webhooks",
+					EnvVar: "STACK_WEBHOOK_SECRET",
+				},
+				cli.StringFlag{
+					Name:   "webhook-secret-file",
+					Usage:  "file containing the secret used to sign webhooks",
+					EnvVar: "STACK_WEBHOOK_SECRET_FILE",
+				},
+				cli.DurationFlag{
+					Name:  "poll-interval",
+					Usage: "time between checks for a new version (default 1m, or watch.poll_interval in the config)",
+				},
+				cli.DurationFlag{
+					Name:  "poll-jitter",
+					Usage: "maximum random time added to the poll interval (default 15s, or watch.jitter in the config)",
+				},
+				cli.StringFlag{
+					Name:   "maintenance",
+					Usage:  "maintenance windows separated by semicolons, e.g. 'mon-fri 22:00-06:00 Europe/Berlin', replacing maintenance in the config",
+					EnvVar: "STACK_MAINTENANCE",
+				},
+			},
 			Action: func(c *cli.Context) {
-				err := watch(c.Args().First())
+				maintenance, err := parseMaintenanceWindows(c.String("maintenance"))
+				if err != nil {
+					log.Fatalln(err)
+				}
+				secret := c.String("webhook-secret")
+				if c.String("webhook-secret-file") != "" {
+					bs, err := ioutil.ReadFile(c.String("webhook-secret-file"))
+					if err != nil {
+						log.Fatalln(err)
+					}
+					secret = strings.TrimSpace(string(bs))
+				}
+				err = watch(c.Args().First(), watchOptions{
+					MetricsAddr:   c.String("metrics-addr"),
+					WebhookAddr:   c.String("webhook-addr"),
+					WebhookSecret: secret,
+					Poll: sync.Options{
+						Interval: c.Duration("poll-interval"),
+						Jitter:   c.Duration("poll-jitter"),
+					},
+					Maintenance: maintenance,
+				})
+				if err == errRestart {
+					// the service manager will start the new binary
+					os.Exit(0)
+				}
 				if err != nil {
 					log.Fatalln(err)
 				}
 			},
 		},
 	}
-	app.Run(os.Args)
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatalln(err)
+	}
 }
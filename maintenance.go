@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/badgerodon/stack/cron"
+)
+
+// A MaintenanceWindow is a time when `watch` may apply new versions, ie
+// "mon-fri 22:00-06:00 Europe/Berlin" or "0 2 * * sat 4h UTC"
+type MaintenanceWindow struct {
+	*cron.Window
+}
+
+// UnmarshalYAML unmarshals a yaml structure
+func (mw *MaintenanceWindow) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var spec string
+	err := unmarshal(&spec)
+	if err != nil {
+		return err
+	}
+	mw.Window, err = cron.ParseWindow(spec)
+	return err
+}
+
+// parseMaintenanceWindows parses a list of windows separated by semicolons
+func parseMaintenanceWindows(spec string) ([]MaintenanceWindow, error) {
+	var windows []MaintenanceWindow
+	for _, part := range strings.Split(spec, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		w, err := cron.ParseWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, MaintenanceWindow{w})
+	}
+	return windows, nil
+}
+
+// maintenanceOpen returns true if t is inside one of the windows, or if there
+// aren't any. Otherwise it returns the time the next window opens.
+func maintenanceOpen(windows []MaintenanceWindow, t time.Time) (bool, time.Time) {
+	if len(windows) == 0 {
+		return true, t
+	}
+	var next time.Time
+	for _, w := range windows {
+		n := w.Next(t)
+		if n.Equal(t) {
+			return true, t
+		}
+		if !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return false, next
+}
+
+// pendingChanges describes the applications that applying the config would
+// change
+func pendingChanges(state *StackState, cfg *Config) []string {
+	var changes []string
+	for _, app := range cfg.Applications {
+		var installed *Application
+		for i, pa := range state.Applications {
+			if pa.Name == app.Name {
+				installed = &state.Applications[i]
+			}
+		}
+		switch {
+		case installed == nil:
+			changes = append(changes, "install "+app.Name)
+		default:
+			// the versions of watched sources are only checked when applying
+			app.SourceVersion = installed.SourceVersion
+			if app.Hash() != installed.Hash() {
+				changes = append(changes, "update "+app.Name)
+			}
+		}
+	}
+	for _, pa := range state.Applications {
+		found := false
+		for _, app := range cfg.Applications {
+			if app.Name == pa.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			changes = append(changes, "remove "+pa.Name)
+		}
+	}
+	return changes
+}
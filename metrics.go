@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	stacksync "github.com/badgerodon/stack/sync"
+
+	"github.com/badgerodon/stack/logging"
+)
+
+// metrics are collected by the daemon and exposed in the Prometheus text
+// format
+type metrics struct {
+	mu               sync.Mutex
+	applies          map[string]int
+	applySeconds     float64
+	failures         map[string]int
+	lastApply        time.Time
+	lastApplySeconds float64
+}
+
+var stackMetrics = &metrics{
+	applies:  map[string]int{},
+	failures: map[string]int{},
+}
+
+// recordApply records the outcome of an apply
+func (m *metrics) recordApply(start time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elapsed := time.Since(start).Seconds()
+	m.applySeconds += elapsed
+	m.lastApplySeconds = elapsed
+	if err != nil {
+		m.applies["failure"]++
+		m.failures[errorDetails(err).stage]++
+	} else {
+		m.applies["success"]++
+		m.lastApply = time.Now()
+	}
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// writeMetric writes a metric in the Prometheus text format. samples maps
+// label strings (`a="b",c="d"`) to values.
+func writeMetric(w io.Writer, name, typ, help string, samples map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	var labels []string
+	for l := range samples {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		if l == "" {
+			fmt.Fprintf(w, "%s %v\n", name, samples[l])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, l, samples[l])
+		}
+	}
+}
+
+func timestamp(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+func (m *metrics) write(w io.Writer, watcher *stacksync.Watcher) {
+	m.mu.Lock()
+	applies := map[string]float64{}
+	count := 0
+	for _, result := range []string{"success", "failure"} {
+		applies[`result="`+result+`"`] = float64(m.applies[result])
+		count += m.applies[result]
+	}
+	failures := map[string]float64{}
+	for _, stage := range []string{stageDownload, stageExtract, stageInstall} {
+		failures[`stage="`+stage+`"`] = float64(m.failures[stage])
+	}
+	applySeconds := m.applySeconds
+	lastApplySeconds := m.lastApplySeconds
+	lastApply := m.lastApply
+	m.mu.Unlock()
+
+	writeMetric(w, "stack_applies_total", "counter",
+		"Number of times the config was applied.", applies)
+	writeMetric(w, "stack_apply_duration_seconds_total", "counter",
+		"Total time spent applying the config.", map[string]float64{"": applySeconds})
+	writeMetric(w, "stack_apply_last_duration_seconds", "gauge",
+		"Time taken by the most recent apply.", map[string]float64{"": lastApplySeconds})
+	writeMetric(w, "stack_apply_failures_total", "counter",
+		"Number of failed applies by stage.", failures)
+	writeMetric(w, "stack_apply_last_success_timestamp_seconds", "gauge",
+		"Time of the last successful apply.", map[string]float64{"": timestamp(lastApply)})
+	if watcher != nil {
+		writeMetric(w, "stack_watcher_last_check_timestamp_seconds", "gauge",
+			"Time of the last successful version check of the config.",
+			map[string]float64{"": timestamp(watcher.LastCheck())})
+	}
+
+	state := LoadStackState()
+	apps := map[string]float64{}
+	for _, app := range state.Applications {
+		apps[fmt.Sprintf(`application="%s",hash="%s",source_hash="%s"`,
+			escapeLabel(app.Name), app.Hash(), app.SourceHash())] = 1
+	}
+	writeMetric(w, "stack_application_info", "gauge",
+		"Installed applications and their hashes.", apps)
+
+	names, err := serviceManager.List()
+	if err != nil {
+		logging.Error("error listing services", "error", err)
+		return
+	}
+	restarts := map[string]float64{}
+	running := map[string]float64{}
+	for _, name := range names {
+		st, err := serviceManager.Status(name)
+		if err != nil {
+			continue
+		}
+		label := `service="` + escapeLabel(name) + `"`
+		restarts[label] = float64(st.Restarts)
+		if st.Running {
+			running[label] = 1
+		} else {
+			running[label] = 0
+		}
+	}
+	writeMetric(w, "stack_service_restarts_total", "counter",
+		"Number of times a service was restarted after exiting.", restarts)
+	writeMetric(w, "stack_service_running", "gauge",
+		"Whether a service is running.", running)
+}
+
+// serveMetrics serves the metrics over HTTP at addr
+func serveMetrics(addr string, watcher *stacksync.Watcher) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stackMetrics.write(w, watcher)
+	})
+	go func() {
+		logging.Info("metrics listening", "addr", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			logging.Error("metrics stopped", "error", err)
+		}
+	}()
+}
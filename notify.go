@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/badgerodon/stack/logging"
+	"github.com/cenkalti/backoff"
+)
+
+type (
+	// A Notification is a webhook that is sent a JSON POST when something
+	// happens to the stack
+	Notification struct {
+		URL string `yaml:"url"`
+		// Events limits the notification to the given events. By default all
+		// events are sent.
+		Events []string `yaml:"events,omitempty"`
+		// Template is a text/template for the body. By default the
+		// NotificationEvent is sent as JSON.
+		Template string            `yaml:"template,omitempty"`
+		Headers  map[string]string `yaml:"headers,omitempty"`
+		Retries  int               `yaml:"retries,omitempty"`
+	}
+
+	// A NotificationEvent is the payload sent to notifications
+	NotificationEvent struct {
+		Event       string    `json:"event"`
+		Time        time.Time `json:"time"`
+		Host        string    `json:"host"`
+		Application string    `json:"application,omitempty"`
+		Service     string    `json:"service,omitempty"`
+		Message     string    `json:"message,omitempty"`
+		Error       string    `json:"error,omitempty"`
+	}
+)
+
+// notification events
+const (
+	notifyApplySucceeded = "apply-succeeded"
+	notifyApplyFailed    = "apply-failed"
+	notifyRollback       = "rollback"
+	notifyCrashLoop      = "crash-loop"
+)
+
+const defaultNotificationRetries = 3
+
+var (
+	pendingNotifications sync.WaitGroup
+	notificationClient   = &http.Client{Timeout: time.Second * 30}
+	notificationFuncs    = template.FuncMap{
+		// json encodes a value so it can be embedded in a JSON template
+		"json": func(v interface{}) (string, error) {
+			bs, err := json.Marshal(v)
+			return string(bs), err
+		},
+	}
+)
+
+func (n Notification) wants(event string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (n Notification) body(evt NotificationEvent) ([]byte, error) {
+	if n.Template == "" {
+		return json.Marshal(evt)
+	}
+	tpl, err := template.New("notification").Funcs(notificationFuncs).Parse(n.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification template: %v", err)
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, evt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification template: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (n Notification) send(evt NotificationEvent) error {
+	body, err := n.body(evt)
+	if err != nil {
+		return err
+	}
+
+	retries := n.Retries
+	if retries <= 0 {
+		retries = defaultNotificationRetries
+	}
+	eb := backoff.NewExponentialBackOff()
+	eb.MaxElapsedTime = time.Minute * 5
+	return backoff.Retry(func() error {
+		req, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range n.Headers {
+			req.Header.Set(k, v)
+		}
+		res, err := notificationClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("unexpected status: %s", res.Status)
+		}
+		return nil
+	}, backoff.WithMaxRetries(eb, uint64(retries)))
+}
+
+// notify sends the event to every notification that wants it. Notifications
+// are sent in the background, use waitNotifications to wait for them.
+func notify(notifications []Notification, evt NotificationEvent) {
+	evt.Time = time.Now()
+	evt.Host, _ = os.Hostname()
+	for _, n := range notifications {
+		if !n.wants(evt.Event) {
+			continue
+		}
+		pendingNotifications.Add(1)
+		go func(n Notification) {
+			defer pendingNotifications.Done()
+			err := n.send(evt)
+			if err != nil {
+				logging.Error("error sending notification", "event", evt.Event, "url", n.URL, "error", err)
+			}
+		}(n)
+	}
+}
+
+// notifyApply sends the result of an apply
+func notifyApply(notifications []Notification, err error) {
+	if err == nil {
+		notify(notifications, NotificationEvent{Event: notifyApplySucceeded})
+		return
+	}
+	if _, ok := err.(rollbackError); ok {
+		notify(notifications, NotificationEvent{Event: notifyRollback, Error: err.Error()})
+		return
+	}
+	notify(notifications, NotificationEvent{
+		Event:       notifyApplyFailed,
+		Application: errorDetails(err).application,
+		Message:     errorDetails(err).stage,
+		Error:       err.Error(),
+	})
+}
+
+func waitNotifications() {
+	pendingNotifications.Wait()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/badgerodon/stack/logging"
+)
+
+const (
+	defaultMinPort = 20000
+	defaultMaxPort = 29999
+)
+
+type (
+	// A PortRange is the range ports are allocated from
+	PortRange struct {
+		Min int `yaml:"min,omitempty"`
+		Max int `yaml:"max,omitempty"`
+	}
+
+	// A Registry describes the applications managed by the stack so that
+	// they can find one another
+	Registry struct {
+		Applications map[string]RegistryEntry `json:"applications"`
+	}
+	// A RegistryEntry describes a single application
+	RegistryEntry struct {
+		Ports map[string]int `json:"ports"`
+	}
+)
+
+func (pr PortRange) bounds() (int, int) {
+	min, max := pr.Min, pr.Max
+	if min <= 0 {
+		min = defaultMinPort
+	}
+	if max <= 0 {
+		max = defaultMaxPort
+	}
+	return min, max
+}
+
+// portEnvironmentVariable returns the environment variable used for a named
+// port. The port named `default` is `PORT`, all others are `PORT_{NAME}`.
+func portEnvironmentVariable(name string) string {
+	if name == "default" {
+		return "PORT"
+	}
+	return "PORT_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func registryPath() string {
+	return filepath.Join(rootDir, "registry.json")
+}
+
+func isPortAvailable(port int) bool {
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// allocatePorts assigns ports to every application in the config. Ports are
+// keyed by application and port name so they stay the same across upgrades.
+// Ports for applications no longer in the config are released.
+func allocatePorts(state *StackState, cfg *Config) error {
+	wanted := map[string]map[string]struct{}{}
+	for _, app := range cfg.Applications {
+		names := map[string]struct{}{}
+		for _, name := range app.Ports {
+			names[name] = struct{}{}
+		}
+		wanted[app.Name] = names
+	}
+
+	used := map[int]struct{}{}
+	for app, ports := range state.Ports {
+		for name, port := range ports {
+			if _, ok := wanted[app][name]; !ok {
+				logging.Info("release port", "app", app, "name", name, "port", port)
+				delete(ports, name)
+				continue
+			}
+			used[port] = struct{}{}
+		}
+		if len(ports) == 0 {
+			delete(state.Ports, app)
+		}
+	}
+
+	min, max := cfg.Ports.bounds()
+	next := min
+	for _, app := range cfg.Applications {
+		for _, name := range app.Ports {
+			if _, ok := state.Ports[app.Name][name]; ok {
+				continue
+			}
+			for ; next <= max; next++ {
+				if _, ok := used[next]; !ok && isPortAvailable(next) {
+					break
+				}
+			}
+			if next > max {
+				return fmt.Errorf("no ports available in range %d-%d", min, max)
+			}
+			if state.Ports[app.Name] == nil {
+				state.Ports[app.Name] = map[string]int{}
+			}
+			logging.Info("allocate port", "app", app.Name, "name", name, "port", next)
+			state.Ports[app.Name][name] = next
+			used[next] = struct{}{}
+		}
+	}
+	SaveStackState(state)
+
+	return writeRegistry(state)
+}
+
+// writeRegistry publishes the allocated ports to the registry file
+func writeRegistry(state *StackState) error {
+	registry := Registry{
+		Applications: map[string]RegistryEntry{},
+	}
+	for app, ports := range state.Ports {
+		registry.Applications[app] = RegistryEntry{Ports: ports}
+	}
+	bs, err := json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := registryPath() + ".tmp"
+	err = ioutil.WriteFile(tmp, bs, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, registryPath())
+}
+
+// portEnvironment returns the environment variables for an application's
+// allocated ports along with the location of the registry
+func portEnvironment(state *StackState, app Application) map[string]string {
+	env := map[string]string{
+		"STACK_REGISTRY": registryPath(),
+	}
+	for _, name := range app.Ports {
+		if port, ok := state.Ports[app.Name][name]; ok {
+			env[portEnvironmentVariable(name)] = strconv.Itoa(port)
+		}
+	}
+	return env
+}
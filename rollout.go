@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/badgerodon/stack/logging"
+	"github.com/badgerodon/stack/storage"
+)
+
+type (
+	// ApplicationRollout stages new versions of an application across hosts.
+	// Hosts are assigned to waves by a hash of their hostname. The first wave
+	// installs a new version right away, later waves wait for Delay after the
+	// previous wave and, if a Status location is set, for the hosts in earlier
+	// waves to report that they're healthy.
+	ApplicationRollout struct {
+		// Waves are cumulative percentages of hosts, ie [10, 50, 100]. Hosts
+		// that aren't in any wave keep the installed version.
+		Waves []int `yaml:"waves,omitempty"`
+		// Percent is shorthand for a single wave
+		Percent int `yaml:"percent,omitempty"`
+		// Delay is the minimum time between waves
+		Delay time.Duration `yaml:"delay,omitempty"`
+		// Status is a folder where hosts publish their rollout status
+		Status storage.Location `yaml:"status,omitempty"`
+	}
+
+	// RolloutState is the local state of a version of an application with a
+	// rollout policy
+	RolloutState struct {
+		Application string
+		// FirstSeen is when the version was first seen in the config
+		FirstSeen time.Time
+		// InstalledAt is when the version was installed on this host
+		InstalledAt time.Time `json:",omitempty"`
+	}
+
+	// A RolloutReport is published by every host to the status location
+	RolloutReport struct {
+		Host        string    `json:"host"`
+		Application string    `json:"application"`
+		Version     string    `json:"version"`
+		Wave        int       `json:"wave"`
+		Healthy     bool      `json:"healthy"`
+		Error       string    `json:"error,omitempty"`
+		InstalledAt time.Time `json:"installed_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
+	}
+)
+
+// rolloutCheckInterval is how often hosts check whether they can proceed with
+// a rollout, and report their health
+const rolloutCheckInterval = time.Minute
+
+func (r ApplicationRollout) enabled() bool {
+	return len(r.Waves) > 0 || r.Percent > 0
+}
+
+func (r ApplicationRollout) waves() []int {
+	if len(r.Waves) > 0 {
+		return r.Waves
+	}
+	return []int{r.Percent}
+}
+
+// hostBucket maps a host to a number in [0, 100)
+func hostBucket(host string) int {
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return int(h.Sum32() % 100)
+}
+
+// wave returns the wave a host is in, or -1 if it isn't in any
+func (r ApplicationRollout) wave(host string) int {
+	bucket := hostBucket(host)
+	for i, percent := range r.waves() {
+		if bucket < percent {
+			return i
+		}
+	}
+	return -1
+}
+
+// rolloutVersion identifies a version of an application in status files
+func rolloutVersion(app Application) string {
+	return strings.ToLower(app.Hash()[:16])
+}
+
+// statusLocation returns the location of a file in the status folder
+func (r ApplicationRollout) statusLocation(elems ...string) storage.Location {
+	return r.Status.Join(elems...)
+}
+
+// reports returns the reports published for a version of an application
+func (r ApplicationRollout) reports(app Application) ([]RolloutReport, error) {
+	dir := r.statusLocation(app.Name, rolloutVersion(app))
+	names, err := storage.List(dir)
+	if err != nil {
+		// nothing has been published yet
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var reports []RolloutReport
+	for _, name := range names {
+		name = path.Base(strings.TrimSuffix(name, "/"))
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		rc, err := storage.Get(r.statusLocation(app.Name, rolloutVersion(app), name))
+		if err != nil {
+			return nil, err
+		}
+		var report RolloutReport
+		err = json.NewDecoder(rc).Decode(&report)
+		rc.Close()
+		if err != nil {
+			logging.Warn("invalid rollout report", "app", app.Name, "path", name, "error", err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// rolloutReady returns whether a new version of an application can be
+// installed on this host, and if not why
+func rolloutReady(state *StackState, app Application, host string, now time.Time) (bool, string) {
+	r := app.Rollout
+	wave := r.wave(host)
+	if wave < 0 {
+		return false, "host is not in a rollout wave"
+	}
+	if wave == 0 {
+		return true, ""
+	}
+
+	// without status reports, waves are only separated by time
+	byTime := func() (bool, string) {
+		start := state.Rollouts[app.Hash()].FirstSeen.Add(r.Delay * time.Duration(wave))
+		if now.Before(start) {
+			return false, fmt.Sprintf("wave %d starts at %s", wave, start.Format(time.RFC3339))
+		}
+		return true, ""
+	}
+	if r.Status == nil {
+		return byTime()
+	}
+
+	reports, err := r.reports(app)
+	if err != nil {
+		return false, fmt.Sprintf("error reading rollout status: %v", err)
+	}
+	// the latest earlier wave with reports decides when this wave starts.
+	// Waves without any hosts never report, so they're skipped.
+	latest := -1
+	var started time.Time
+	for _, report := range reports {
+		if report.Wave >= wave {
+			continue
+		}
+		if !report.Healthy {
+			return false, fmt.Sprintf("%s in wave %d is unhealthy: %s", report.Host, report.Wave, report.Error)
+		}
+		if report.Wave > latest || (report.Wave == latest && report.InstalledAt.Before(started)) {
+			latest = report.Wave
+			started = report.InstalledAt
+		}
+	}
+	if latest < 0 {
+		// no host is in an earlier wave, ie in a small fleet or with a
+		// small first wave
+		return byTime()
+	}
+	start := started.Add(r.Delay * time.Duration(wave-latest))
+	if now.Before(start) {
+		return false, fmt.Sprintf("wave %d starts at %s", wave, start.Format(time.RFC3339))
+	}
+	return true, ""
+}
+
+// applyRollouts returns the config with new versions of applications that
+// haven't rolled out to this host replaced by the installed versions
+func applyRollouts(state *StackState, cfg *Config) *Config {
+	host, _ := os.Hostname()
+	now := time.Now()
+
+	effective := *cfg
+	effective.Applications = make([]Application, len(cfg.Applications))
+	copy(effective.Applications, cfg.Applications)
+
+	seen := map[string]bool{}
+	for i, app := range effective.Applications {
+		if !app.Rollout.enabled() {
+			continue
+		}
+		hash := app.Hash()
+		seen[hash] = true
+
+		var installed *Application
+		for j, pa := range state.Applications {
+			if pa.Name == app.Name {
+				installed = &state.Applications[j]
+			}
+		}
+		// new applications and installed versions aren't staged
+		if installed == nil || installed.Hash() == hash {
+			continue
+		}
+
+		rs, ok := state.Rollouts[hash]
+		if !ok {
+			rs = RolloutState{Application: app.Name, FirstSeen: now}
+			state.Rollouts[hash] = rs
+			SaveStackState(state)
+		}
+
+		ready, reason := rolloutReady(state, app, host, now)
+		if !ready {
+			logging.Info("rollout waiting", "app", app.Name, "version", rolloutVersion(app), "reason", reason)
+			held := *installed
+			held.Rollout = app.Rollout
+			effective.Applications[i] = held
+			seen[installed.Hash()] = true
+		}
+	}
+	// forget versions that are no longer in the config
+	for hash := range state.Rollouts {
+		if !seen[hash] {
+			delete(state.Rollouts, hash)
+		}
+	}
+	return &effective
+}
+
+// rolloutInstalled records when a version with a rollout policy was installed
+func rolloutInstalled(state *StackState, app Application) {
+	if !app.Rollout.enabled() {
+		return
+	}
+	rs := state.Rollouts[app.Hash()]
+	rs.Application = app.Name
+	if rs.FirstSeen.IsZero() {
+		rs.FirstSeen = time.Now()
+	}
+	rs.InstalledAt = time.Now()
+	state.Rollouts[app.Hash()] = rs
+}
+
+// rolloutsReady returns true if any application in the config has a version
+// held back by its rollout that can now be installed on this host
+func rolloutsReady(state *StackState, cfg *Config) bool {
+	host, _ := os.Hostname()
+	now := time.Now()
+	for _, app := range cfg.Applications {
+		if !app.Rollout.enabled() {
+			continue
+		}
+		found := false
+		for _, pa := range state.Applications {
+			if pa.Hash() == app.Hash() {
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+		if ready, _ := rolloutReady(state, app, host, now); ready {
+			return true
+		}
+	}
+	return false
+}
+
+// applicationHealth returns an error if any of the application's services
+// aren't healthy
+func applicationHealth(app Application) error {
+	for _, name := range app.ServiceNames() {
+		st, err := serviceManager.Status(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if app.Schedule != "" {
+			if !st.LastRun.IsZero() && st.LastExitStatus != 0 {
+				return fmt.Errorf("%s exited with %d", name, st.LastExitStatus)
+			}
+			continue
+		}
+		if !st.Running {
+			return fmt.Errorf("%s is not running", name)
+		}
+	}
+	return nil
+}
+
+// reportRollouts publishes the health of the installed versions of
+// applications with a rollout status location
+func reportRollouts(cfg *Config) {
+	state := LoadStackState()
+	host, _ := os.Hostname()
+	for _, app := range cfg.Applications {
+		r := app.Rollout
+		if !r.enabled() || r.Status == nil {
+			continue
+		}
+		for _, pa := range state.Applications {
+			if pa.Name != app.Name {
+				continue
+			}
+			report := RolloutReport{
+				Host:        host,
+				Application: pa.Name,
+				Version:     rolloutVersion(pa),
+				Wave:        r.wave(host),
+				Healthy:     true,
+				InstalledAt: state.Rollouts[pa.Hash()].InstalledAt,
+				UpdatedAt:   time.Now(),
+			}
+			// versions installed before the rollout policy was added are
+			// only reported once they're replaced
+			if report.InstalledAt.IsZero() {
+				continue
+			}
+			if err := applicationHealth(pa); err != nil {
+				report.Healthy = false
+				report.Error = err.Error()
+			}
+			bs, _ := json.Marshal(report)
+			err := storage.Put(r.statusLocation(pa.Name, report.Version, host+".json"), bytes.NewReader(bs))
+			if err != nil {
+				logging.Warn("error publishing rollout status", "app", pa.Name, "location", r.Status, "error", err)
+			}
+		}
+	}
+}
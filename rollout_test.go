@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/badgerodon/stack/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// rolloutHost returns a host name in the given wave
+func rolloutHost(r ApplicationRollout, wave int) string {
+	for i := 0; ; i++ {
+		host := fmt.Sprintf("host-%d", i)
+		if r.wave(host) == wave {
+			return host
+		}
+	}
+}
+
+func TestRolloutReady(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stack-rollout-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	status, _ := storage.ParseLocation(dir)
+
+	app := Application{Name: "app", Rollout: ApplicationRollout{
+		Waves:  []int{10, 50, 100},
+		Delay:  time.Hour,
+		Status: status,
+	}}
+	firstSeen := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	state := &StackState{Rollouts: map[string]RolloutState{
+		app.Hash(): {Application: app.Name, FirstSeen: firstSeen},
+	}}
+	host := rolloutHost(app.Rollout, 1)
+
+	// the first wave installs right away
+	ready, _ := rolloutReady(state, app, rolloutHost(app.Rollout, 0), firstSeen)
+	assert.True(ready)
+
+	// no host in wave 0 ever reports, so the delay after the version was
+	// first seen decides
+	ready, reason := rolloutReady(state, app, host, firstSeen.Add(30*time.Minute))
+	assert.False(ready)
+	assert.Contains(reason, "wave 1 starts at")
+	ready, _ = rolloutReady(state, app, host, firstSeen.Add(time.Hour))
+	assert.True(ready)
+
+	// once an earlier wave reports, its install time decides
+	report := func(r RolloutReport) {
+		bs, _ := json.Marshal(r)
+		err := storage.Put(app.Rollout.statusLocation(app.Name, rolloutVersion(app), r.Host+".json"), bytes.NewReader(bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	installed := firstSeen.Add(2 * time.Hour)
+	report(RolloutReport{Host: "canary", Wave: 0, Healthy: true, InstalledAt: installed})
+	ready, _ = rolloutReady(state, app, host, installed.Add(30*time.Minute))
+	assert.False(ready)
+	ready, _ = rolloutReady(state, app, host, installed.Add(time.Hour))
+	assert.True(ready)
+
+	// an unhealthy host stops later waves
+	report(RolloutReport{Host: "canary", Wave: 0, Healthy: false, Error: "crashed", InstalledAt: installed})
+	ready, reason = rolloutReady(state, app, host, installed.Add(time.Hour))
+	assert.False(ready)
+	assert.Contains(reason, "crashed")
+}
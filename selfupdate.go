@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/badgerodon/stack/logging"
+	"github.com/badgerodon/stack/storage"
+	"github.com/minio/blake2b-simd"
+	"golang.org/x/crypto/ed25519"
+)
+
+// errRestart is returned by watch when it should exit so that the service
+// manager restarts it
+var errRestart = errors.New("restart required")
+
+// selfUpdateTimeout is how long a new stack binary has to apply the config
+// successfully before the previous binary is restored
+const selfUpdateTimeout = 5 * time.Minute
+
+// StackUpdate describes where to get the stack binary itself
+type StackUpdate struct {
+	Source storage.Location `yaml:"source,omitempty"`
+	// Checksum is `{algorithm}:{hex}` where algorithm is sha256 or sha512
+	Checksum string `yaml:"checksum,omitempty"`
+	// Signature is the location of a detached ed25519 signature of the
+	// binary, verified with the base64 encoded PublicKey
+	Signature storage.Location `yaml:"signature,omitempty"`
+	PublicKey string           `yaml:"public_key,omitempty"`
+}
+
+func stackPath() string {
+	return filepath.Join(rootDir, "stack")
+}
+
+// selfUpdatePath is the file holding the deadline of a new stack binary that
+// hasn't proven itself yet
+func selfUpdatePath() string {
+	return filepath.Join(rootDir, "stack.update")
+}
+
+// key identifies the update, including the version of the source so that a
+// new binary at the same location is picked up
+func (su StackUpdate) key() string {
+	bs, _ := json.Marshal(su)
+	version, _ := storage.Version(su.Source, "")
+	return fmt.Sprintf("%X/%s", blake2b.Sum512(bs), version)
+}
+
+func (su StackUpdate) verifyChecksum(bs []byte) error {
+	if su.Checksum == "" {
+		return nil
+	}
+	algorithm, expect := "sha256", su.Checksum
+	if i := strings.Index(su.Checksum, ":"); i >= 0 {
+		algorithm, expect = su.Checksum[:i], su.Checksum[i+1:]
+	}
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+	}
+	h.Write(bs)
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, expect) {
+		return fmt.Errorf("checksum mismatch, expected %s got %s", expect, actual)
+	}
+	return nil
+}
+
+func (su StackUpdate) verifySignature(bs []byte) error {
+	if len(su.Signature) == 0 {
+		return nil
+	}
+	pub, err := base64.StdEncoding.DecodeString(su.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key")
+	}
+	rc, err := storage.Get(su.Signature)
+	if err != nil {
+		return fmt.Errorf("error downloading signature: %v", err)
+	}
+	defer rc.Close()
+	sig, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("error downloading signature: %v", err)
+	}
+	// accept both raw and base64 encoded signatures
+	if len(sig) != ed25519.SignatureSize {
+		sig, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), bs, sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// selfTest runs the self-test command of the binary at path with the config
+// at src
+func selfTest(path, src string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "self-test", src).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("self-test failed: %v: %s", err, out)
+	}
+	return nil
+}
+
+// a rollbackError is returned when a new stack binary was installed but had
+// to be reverted
+type rollbackError struct {
+	err error
+}
+
+func (err rollbackError) Error() string {
+	return "reverted stack binary: " + err.err.Error()
+}
+
+// selfUpdate replaces the stack binary in the root directory with the one
+// declared in the config at src. It returns true if the binary was replaced.
+func selfUpdate(src string, cfg *Config) (bool, error) {
+	su := cfg.Stack
+	if len(su.Source) == 0 {
+		return false, nil
+	}
+
+	// the state is saved, so this can't overlap an apply
+	pl := NewPortLock(49001)
+	pl.Lock()
+	defer pl.Unlock()
+
+	state := ReadStackState()
+	key := su.key()
+	if state.Stack == key {
+		return false, nil
+	}
+
+	logging.Info("download stack", "location", su.Source, "stage", stageDownload)
+	rc, err := storage.Get(su.Source)
+	if err != nil {
+		return false, fmt.Errorf("error downloading stack: %v", err)
+	}
+	bs, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return false, fmt.Errorf("error downloading stack: %v", err)
+	}
+
+	err = su.verifyChecksum(bs)
+	if err != nil {
+		return false, err
+	}
+	err = su.verifySignature(bs)
+	if err != nil {
+		return false, err
+	}
+
+	newPath := stackPath() + ".new"
+	oldPath := stackPath() + ".old"
+	err = ioutil.WriteFile(newPath, bs, 0755)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(newPath)
+
+	if current, err := ioutil.ReadFile(stackPath()); err == nil && bytes.Equal(current, bs) {
+		logging.Info("stack already up to date")
+		state.Stack = key
+		SaveStackState(state)
+		return false, nil
+	}
+
+	err = selfTest(newPath, src)
+	if err != nil {
+		return false, err
+	}
+
+	logging.Info("replace stack", "path", stackPath(), "stage", stageInstall)
+	os.Remove(oldPath)
+	hasOld := os.Rename(stackPath(), oldPath) == nil
+	err = os.Rename(newPath, stackPath())
+	if err == nil {
+		err = selfTest(stackPath(), src)
+	}
+	if err == nil && hasOld {
+		deadline := time.Now().Add(selfUpdateTimeout).UTC().Format(time.RFC3339)
+		err = ioutil.WriteFile(selfUpdatePath(), []byte(deadline), 0644)
+	}
+	if err != nil {
+		if hasOld {
+			logging.Warn("revert stack", "path", stackPath(), "error", err)
+			os.Rename(oldPath, stackPath())
+			return false, rollbackError{err}
+		}
+		return false, err
+	}
+
+	state.Stack = key
+	SaveStackState(state)
+	return true, nil
+}
+
+// selfUpdateDeadline returns the time a new stack binary has to apply the
+// config by, if it hasn't yet
+func selfUpdateDeadline() (time.Time, bool) {
+	bs, err := ioutil.ReadFile(selfUpdatePath())
+	if err != nil {
+		return time.Time{}, false
+	}
+	deadline, err := time.Parse(time.RFC3339, strings.TrimSpace(string(bs)))
+	return deadline, err == nil
+}
+
+// confirmSelfUpdate marks the running binary as healthy
+func confirmSelfUpdate() {
+	if os.Remove(selfUpdatePath()) == nil {
+		logging.Info("stack update confirmed", "path", stackPath())
+	}
+}
+
+// revertSelfUpdate restores the previous stack binary. The key of the update
+// stays in the state, so the same binary isn't installed again.
+func revertSelfUpdate() error {
+	logging.Warn("revert stack", "path", stackPath(), "error", "not healthy after the update")
+	err := os.Rename(stackPath()+".old", stackPath())
+	os.Remove(selfUpdatePath())
+	return err
+}
+
+// watchSelfUpdate restores the previous stack binary and exits if the
+// running one isn't confirmed before its deadline. The returned function
+// stops the timer.
+func watchSelfUpdate() (func(), error) {
+	deadline, ok := selfUpdateDeadline()
+	if !ok {
+		return func() {}, nil
+	}
+	if !time.Now().Before(deadline) {
+		revertSelfUpdate()
+		return nil, errRestart
+	}
+	// the apply may be stuck, so rather than waiting for it the process exits
+	// and the service manager starts the previous binary
+	t := time.AfterFunc(time.Until(deadline), func() {
+		if _, ok := selfUpdateDeadline(); ok {
+			revertSelfUpdate()
+			os.Exit(0)
+		}
+	})
+	return func() { t.Stop() }, nil
+}
+
+// runSelfTest checks that the binary works on this host: the root directory
+// exists, the service manager can be used and the config at src, if any,
+// parses. It runs next to the daemon, so it mustn't change anything.
+func runSelfTest(w io.Writer, src string) error {
+	if serviceManager == nil {
+		return fmt.Errorf("no service manager")
+	}
+	fi, err := os.Stat(rootDir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", rootDir)
+	}
+	if err := serviceManager.Check(); err != nil {
+		return fmt.Errorf("error checking %s: %v", serviceManager, err)
+	}
+	if src != "" {
+		if _, err := readConfig(src); err != nil {
+			return fmt.Errorf("error reading config: %v", err)
+		}
+	}
+	fmt.Fprintln(w, "ok", serviceManager)
+	return nil
+}
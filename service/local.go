@@ -7,7 +7,9 @@ import (
 	"os"
 	"os/exec"
 	"sync"
+	"time"
 
+	"github.com/badgerodon/stack/logging"
 	"github.com/badgerodon/stack/service/runner"
 	"github.com/kardianos/osext"
 )
@@ -17,6 +19,8 @@ type (
 	LocalManager struct {
 		stateFile string
 		client    *rpc.Client
+		runner    *exec.Cmd
+		exited    chan struct{}
 		mu        sync.Mutex
 	}
 )
@@ -33,6 +37,22 @@ func (lsm *LocalManager) String() string {
 	return fmt.Sprintf("LocalManager(state-file=%s)", lsm.stateFile)
 }
 
+// Check checks that the runner can be started and its state read. The
+// runner itself isn't started, as it would start every service again next to
+// the ones already running.
+func (lsm *LocalManager) Check() error {
+	if _, err := osext.Executable(); err != nil {
+		return err
+	}
+	f, err := os.Open(lsm.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 func (lsm *LocalManager) call(serviceMethod string, args interface{}, reply interface{}) error {
 	lsm.mu.Lock()
 	defer lsm.mu.Unlock()
@@ -49,14 +69,23 @@ func (lsm *LocalManager) call(serviceMethod string, args interface{}, reply inte
 		}
 		defer listener.Close()
 
+		logging.Info("start service runner", "addr", listener.Addr().String())
 		runner := exec.Command(exe, "service-runner", "--address", listener.Addr().String(), "--state-file", lsm.stateFile)
 		runner.Stdout = os.Stdout
 		runner.Stderr = os.Stderr
+		err = runner.Start()
+		if err != nil {
+			return err
+		}
+		exited := make(chan struct{})
+		lsm.runner, lsm.exited = runner, exited
 		go func() {
-			runner.Run()
+			err := runner.Wait()
+			logging.Warn("service runner exited", "error", err)
 			lsm.mu.Lock()
 			lsm.client = nil
 			lsm.mu.Unlock()
+			close(exited)
 		}()
 
 		conn, err := listener.Accept()
@@ -69,6 +98,27 @@ func (lsm *LocalManager) call(serviceMethod string, args interface{}, reply inte
 	return lsm.client.Call(serviceMethod, args, reply)
 }
 
+// Close stops the service runner started by this manager, which stops the
+// services it runs
+func (lsm *LocalManager) Close() error {
+	lsm.mu.Lock()
+	client, runner, exited := lsm.client, lsm.runner, lsm.exited
+	lsm.mu.Unlock()
+	if client == nil {
+		return nil
+	}
+
+	// the runner exits once its connection is closed
+	client.Close()
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		runner.Process.Kill()
+		<-exited
+	}
+	return nil
+}
+
 // Install installs the service
 func (lsm *LocalManager) Install(service Service) error {
 	req := runner.InstallRequest{
@@ -77,6 +127,12 @@ func (lsm *LocalManager) Install(service Service) error {
 			Directory:   service.Directory,
 			Command:     service.Command,
 			Environment: service.Environment,
+			Limits: runner.Limits{
+				Memory:   service.Limits.Memory,
+				CPUQuota: service.Limits.CPUQuota,
+				NoFile:   service.Limits.NoFile,
+			},
+			Schedule: service.Schedule,
 		},
 	}
 	var res runner.InstallResult
@@ -110,3 +166,24 @@ func (lsm *LocalManager) List() ([]string, error) {
 	}
 	return res.Names, nil
 }
+
+// Status returns the status of the service
+func (lsm *LocalManager) Status(name string) (Status, error) {
+	req := runner.StatusRequest{
+		Name: name,
+	}
+	var res runner.StatusResult
+	err := lsm.call("Runner.Status", &req, &res)
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{
+		Name:           name,
+		Running:        res.Running,
+		PID:            res.PID,
+		Schedule:       res.Schedule,
+		LastRun:        res.LastRun,
+		LastExitStatus: res.LastExitStatus,
+		Restarts:       res.Restarts,
+	}, nil
+}
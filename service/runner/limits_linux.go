@@ -0,0 +1,207 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	cgroupRoot   = "/sys/fs/cgroup"
+	cgroupPeriod = 100000
+)
+
+// cgroup is the runner's own cgroup, which the services' cgroups are created
+// in. It's set up the first time a service needs one.
+var cgroup struct {
+	sync.Mutex
+	dir  string
+	err  error
+	done bool
+}
+
+// hasCgroup2 returns true if the unified (v2) cgroup hierarchy is mounted
+func hasCgroup2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// ownCgroup returns the cgroup the runner was started in
+func ownCgroup() (string, error) {
+	bs, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(bs), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			if line[3:] == "/" {
+				return "", fmt.Errorf("the runner is in the root cgroup")
+			}
+			return filepath.Join(cgroupRoot, line[3:]), nil
+		}
+	}
+	return "", fmt.Errorf("cgroup v2 is not available")
+}
+
+// delegated returns true if systemd delegated the cgroup to its processes,
+// which is what Delegate=yes on their unit does. systemd marks delegated
+// cgroups with an extended attribute.
+func delegated(dir string) bool {
+	buf := make([]byte, 8)
+	for _, attr := range []string{"trusted.delegate", "user.delegate"} {
+		n, err := syscall.Getxattr(dir, attr, buf)
+		if err == nil && string(buf[:n]) == "1" {
+			return true
+		}
+	}
+	return false
+}
+
+// initCgroup enables the cpu and memory controllers for the children of the
+// runner's cgroup. Only leaves can have processes, so the processes already
+// in it are moved to a leaf of their own. Nothing outside of the runner's
+// cgroup is changed.
+//
+// systemd owns the cgroups of its units, so this is only done when the
+// cgroup was delegated to the runner. The stack's own unit is installed with
+// Delegate=yes for this.
+func initCgroup() (string, error) {
+	if !hasCgroup2() {
+		return "", fmt.Errorf("cgroup v2 is not available")
+	}
+	dir, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	if !delegated(dir) {
+		return "", fmt.Errorf("the runner's cgroup %s isn't delegated to it, its unit needs Delegate=yes", dir)
+	}
+
+	leaf := filepath.Join(dir, "runner")
+	err = os.MkdirAll(leaf, 0755)
+	if err != nil {
+		return "", err
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return "", err
+	}
+	for _, pid := range strings.Fields(string(bs)) {
+		err = ioutil.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644)
+		if err != nil {
+			return "", fmt.Errorf("error moving %s to %s: %v", pid, leaf, err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644)
+	if err != nil {
+		return "", fmt.Errorf("error enabling controllers in %s: %v", dir, err)
+	}
+	return dir, nil
+}
+
+func cgroupParent() (string, error) {
+	cgroup.Lock()
+	defer cgroup.Unlock()
+	if !cgroup.done {
+		cgroup.dir, cgroup.err = initCgroup()
+		cgroup.done = true
+	}
+	return cgroup.dir, cgroup.err
+}
+
+func cgroupPath(parent, name string) string {
+	return filepath.Join(parent, "service-"+name)
+}
+
+// openCgroup creates the cgroup for a service and returns a file descriptor
+// of it for starting the service in
+func openCgroup(name string, limits Limits) (int, error) {
+	parent, err := cgroupParent()
+	if err != nil {
+		return -1, err
+	}
+	dir := cgroupPath(parent, name)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return -1, err
+	}
+
+	memory := "max"
+	if limits.Memory > 0 {
+		memory = strconv.FormatInt(limits.Memory, 10)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(memory), 0644)
+	if err != nil {
+		return -1, err
+	}
+
+	cpu := "max"
+	if limits.CPUQuota > 0 {
+		cpu = strconv.Itoa(limits.CPUQuota * cgroupPeriod / 100)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "cpu.max"), []byte(fmt.Sprintf("%s %d", cpu, cgroupPeriod)), 0644)
+	if err != nil {
+		return -1, err
+	}
+
+	return syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+}
+
+// limitCommand sets up a command to start with the service's limits, so they
+// apply to everything the service starts too. Memory and CPU limits use a
+// cgroup v2 leaf of the runner's cgroup when one is available, otherwise
+// memory falls back to an address space rlimit. Rlimits are set by a shell
+// before it execs the command. The returned function has to be called once
+// the command has started.
+func limitCommand(name string, cmd *exec.Cmd, limits Limits) (func(), error) {
+	release := func() {}
+	var err error
+	var ulimits []string
+	if limits.NoFile > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -n %d", limits.NoFile))
+	}
+
+	if limits.Memory > 0 || limits.CPUQuota > 0 {
+		fd, cerr := openCgroup(name, limits)
+		switch {
+		case cerr == nil:
+			if cmd.SysProcAttr == nil {
+				cmd.SysProcAttr = &syscall.SysProcAttr{}
+			}
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = fd
+			release = func() { syscall.Close(fd) }
+		case limits.CPUQuota > 0:
+			err = fmt.Errorf("cpu quotas require a cgroup: %v", cerr)
+			fallthrough
+		default:
+			if limits.Memory > 0 {
+				ulimits = append(ulimits, fmt.Sprintf("ulimit -v %d", limits.Memory/1024))
+			}
+		}
+	}
+
+	if len(ulimits) > 0 {
+		script := strings.Join(ulimits, " && ") + ` && exec "$0" "$@"`
+		cmd.Args = append([]string{"sh", "-c", script, cmd.Path}, cmd.Args[1:]...)
+		cmd.Path = "/bin/sh"
+	}
+	return release, err
+}
+
+// removeLimits removes any cgroup created for the service
+func removeLimits(name string) {
+	cgroup.Lock()
+	dir, done := cgroup.dir, cgroup.done
+	cgroup.Unlock()
+	if done && dir != "" {
+		os.Remove(cgroupPath(dir, name))
+	}
+}
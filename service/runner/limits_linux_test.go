@@ -0,0 +1,54 @@
+package runner
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	// use the rlimit fallback whatever cgroup the test runs in
+	cgroup.Lock()
+	cgroup.dir, cgroup.err, cgroup.done = "", errors.New("no cgroup"), true
+	cgroup.Unlock()
+	defer func() {
+		cgroup.Lock()
+		cgroup.dir, cgroup.err, cgroup.done = "", nil, false
+		cgroup.Unlock()
+	}()
+
+	cmd := exec.Command("/bin/echo", "a  b", "$HOME")
+	release, err := limitCommand("test", cmd, Limits{})
+	assert.Nil(err)
+	release()
+	assert.Equal("/bin/echo", cmd.Path, "expected no wrapper without limits")
+
+	cmd = exec.Command("/bin/echo", "a  b", "$HOME")
+	release, err = limitCommand("test", cmd, Limits{NoFile: 123, Memory: 512 * 1024 * 1024})
+	assert.Nil(err)
+	release()
+	assert.Equal("/bin/sh", cmd.Path)
+	assert.Equal([]string{
+		"sh", "-c", `ulimit -n 123 && ulimit -v 524288 && exec "$0" "$@"`,
+		"/bin/echo", "a  b", "$HOME",
+	}, cmd.Args)
+	out, err := cmd.Output()
+	assert.Nil(err)
+	assert.Equal("a  b $HOME\n", string(out), "expected the arguments to be passed through unchanged")
+
+	cmd = exec.Command("/bin/sh", "-c", "ulimit -n")
+	release, err = limitCommand("test", cmd, Limits{NoFile: 123})
+	assert.Nil(err)
+	release()
+	out, err = cmd.Output()
+	assert.Nil(err)
+	assert.Equal("123\n", string(out))
+
+	cmd = exec.Command("/bin/echo")
+	_, err = limitCommand("test", cmd, Limits{CPUQuota: 50, Memory: 1024 * 1024})
+	assert.Error(err, "expected cpu quotas to require a cgroup")
+}
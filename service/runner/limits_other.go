@@ -0,0 +1,17 @@
+//go:build !linux
+
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func limitCommand(name string, cmd *exec.Cmd, limits Limits) (func(), error) {
+	if limits.Memory > 0 || limits.CPUQuota > 0 || limits.NoFile > 0 {
+		return func() {}, fmt.Errorf("resource limits are not supported on this platform")
+	}
+	return func() {}, nil
+}
+
+func removeLimits(name string) {}
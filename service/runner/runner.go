@@ -3,7 +3,7 @@ package runner
 import (
 	"bufio"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net"
 	"net/rpc"
 	"os"
@@ -13,6 +13,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/badgerodon/stack/logging"
 )
 
 type (
@@ -20,6 +22,8 @@ type (
 		addr      string
 		stateFile string
 		services  map[string]int
+		restarts  map[string]int
+		jobs      map[string]*job
 		mu        sync.Mutex
 	}
 )
@@ -49,9 +53,19 @@ func Run(addr string, stateFile string) error {
 		addr:      addr,
 		stateFile: stateFile,
 		services:  make(map[string]int),
+		restarts:  make(map[string]int),
+		jobs:      make(map[string]*job),
 	}
 
 	for name, svc := range r.loadState() {
+		if svc.Schedule != "" {
+			j, err := newJob(svc)
+			if err == nil {
+				r.jobs[name] = j
+				go j.loop()
+			}
+			continue
+		}
 		pid, err := r.run(svc)
 		if err == nil {
 			r.services[name] = pid
@@ -61,7 +75,7 @@ func Run(addr string, stateFile string) error {
 	server := rpc.NewServer()
 	server.Register(r)
 
-	log.Println("[runner] connecting to", r.addr)
+	logging.Info("connecting to service manager", "addr", r.addr)
 	conn, err := net.Dial("tcp", r.addr)
 	if err != nil {
 		return err
@@ -76,6 +90,10 @@ func Run(addr string, stateFile string) error {
 		kill(pid)
 	}
 	r.services = make(map[string]int)
+	for _, j := range r.jobs {
+		j.Stop()
+	}
+	r.jobs = make(map[string]*job)
 	r.mu.Unlock()
 
 	return nil
@@ -94,6 +112,9 @@ func (r *Runner) List(req *ListRequest, res *ListResult) error {
 	for name, _ := range r.services {
 		res.Names = append(res.Names, name)
 	}
+	for name := range r.jobs {
+		res.Names = append(res.Names, name)
+	}
 	r.mu.Unlock()
 	sort.Strings(res.Names)
 	return nil
@@ -110,6 +131,13 @@ type (
 		Directory   string
 		Command     []string
 		Environment map[string]string
+		Limits      Limits
+		Schedule    string
+	}
+	Limits struct {
+		Memory   int64
+		CPUQuota int
+		NoFile   uint64
 	}
 )
 
@@ -128,7 +156,8 @@ func (r *Runner) loadState() map[string]Service {
 }
 
 func (r *Runner) saveState(services map[string]Service) {
-	f, err := os.Create(r.stateFile)
+	// the state includes the services' environments
+	f, err := os.OpenFile(r.stateFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return
 	}
@@ -137,68 +166,93 @@ func (r *Runner) saveState(services map[string]Service) {
 	json.NewEncoder(f).Encode(&services)
 }
 
-func (r *Runner) run(service Service) (int, error) {
+// command creates the command for a service with its output sent to the log
+func command(service Service) (*exec.Cmd, error) {
 	cmdName := getCommand(service)
 	cmd := exec.Command(cmdName, service.Command[1:]...)
 	cmd.Dir = service.Directory
+	// like the other service managers, only the service's own environment is
+	// used
 	cmd.Env = []string{}
-	for _, e := range os.Environ() {
-		k := e[:strings.IndexByte(e, '=')]
-		if _, ok := service.Environment[k]; !ok {
-			cmd.Env = append(cmd.Env, e)
-		}
-	}
 	for k, v := range service.Environment {
 		cmd.Env = append(cmd.Env, k+"="+v)
 	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Println("[runner]", service.Name, "failed to create stdout pipe", service.Name)
-		return 0, err
+		logging.Error("failed to create stdout pipe", "service", service.Name, "error", err)
+		return nil, err
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		stdout.Close()
-		log.Println("[runner]", service.Name, "failed to create stderr pipe", service.Name)
-		return 0, err
+		logging.Error("failed to create stderr pipe", "service", service.Name, "error", err)
+		return nil, err
 	}
 
 	go func() {
 		s := bufio.NewScanner(stdout)
 		for s.Scan() {
-			log.Println("["+service.Name+"]", s.Text())
+			logging.Info(s.Text(), "service", service.Name, "stream", "stdout")
 		}
 	}()
 	go func() {
 		s := bufio.NewScanner(stderr)
 		for s.Scan() {
-			log.Println("["+service.Name+"]", s.Text())
+			logging.Info(s.Text(), "service", service.Name, "stream", "stderr")
 		}
 	}()
 
+	return cmd, nil
+}
+
+func (r *Runner) run(service Service) (int, error) {
+	cmd, err := command(service)
+	if err != nil {
+		return 0, err
+	}
+
+	release, err := limitCommand(service.Name, cmd, service.Limits)
+	if err != nil {
+		logging.Warn("failed to apply limits", "service", service.Name, "error", err)
+	}
 	err = cmd.Start()
+	release()
 	if err != nil {
-		log.Println("[runner]", service.Name, "failed to start:", err)
+		logging.Error("failed to start", "service", service.Name, "error", err)
 		return 0, err
 	}
 
 	pid := cmd.Process.Pid
+	started := time.Now()
 
 	go func() {
 		err := cmd.Wait()
-		log.Println("[runner]", service.Name, "exited:", err)
+		logging.Warn("exited", "service", service.Name, "duration", time.Since(started), "error", err)
 		time.Sleep(time.Second * 10)
 		r.mu.Lock()
 		pidNow, ok := r.services[service.Name]
 		r.mu.Unlock()
 		if ok && pidNow == pid {
-			log.Println("[runner] restarting", service.Name)
-			r.run(service)
+			logging.Info("restarting", "service", service.Name)
+			newPID, err := r.run(service)
+			r.mu.Lock()
+			if pidNow, ok := r.services[service.Name]; ok && pidNow == pid {
+				r.restarts[service.Name]++
+				if err == nil {
+					r.services[service.Name] = newPID
+				}
+			} else if err == nil {
+				// the service was replaced while restarting
+				kill(newPID)
+			}
+			r.mu.Unlock()
+		} else if !ok {
+			removeLimits(service.Name)
 		}
 	}()
 
-	log.Println("[runner] started", service.Name, "pid=", cmd.Process.Pid)
+	logging.Info("started", "service", service.Name, "pid", cmd.Process.Pid)
 
 	return pid, nil
 }
@@ -211,8 +265,28 @@ func (r *Runner) Install(req *InstallRequest, res *InstallResult) error {
 		delete(r.services, req.Name)
 		kill(pid)
 	}
+	delete(r.restarts, req.Name)
+	if j, ok := r.jobs[req.Name]; ok {
+		delete(r.jobs, req.Name)
+		j.Stop()
+	}
 	r.mu.Unlock()
 
+	if req.Schedule != "" {
+		j, err := newJob(req.Service)
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.jobs[req.Name] = j
+		services := r.loadState()
+		services[req.Name] = req.Service
+		r.saveState(services)
+		r.mu.Unlock()
+		go j.loop()
+		return nil
+	}
+
 	pid, err := r.run(req.Service)
 	if err != nil {
 		return err
@@ -248,9 +322,40 @@ func (r *Runner) Uninstall(req *UninstallRequest, res *UninstallResult) error {
 		delete(r.services, req.Name)
 		kill(pid)
 	}
+	delete(r.restarts, req.Name)
+	if j, ok := r.jobs[req.Name]; ok {
+		delete(r.jobs, req.Name)
+		j.Stop()
+	}
 	services := r.loadState()
-	delete(r.services, req.Name)
+	delete(services, req.Name)
 	r.saveState(services)
 	r.mu.Unlock()
 	return nil
 }
+
+type (
+	StatusRequest struct {
+		Name string
+	}
+	StatusResult struct {
+		ServiceStatus
+	}
+)
+
+func (r *Runner) Status(req *StatusRequest, res *StatusResult) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pid, ok := r.services[req.Name]; ok {
+		res.Running = true
+		res.PID = pid
+		res.Restarts = r.restarts[req.Name]
+		return nil
+	}
+	if j, ok := r.jobs[req.Name]; ok {
+		res.ServiceStatus = j.Status()
+		return nil
+	}
+	return fmt.Errorf("unknown service: %s", req.Name)
+}
@@ -0,0 +1,183 @@
+package runner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badgerodon/stack/cron"
+	"github.com/badgerodon/stack/logging"
+)
+
+type (
+	// ServiceStatus is the current state of a service
+	ServiceStatus struct {
+		Running        bool
+		PID            int
+		Schedule       string
+		LastRun        time.Time
+		LastExitStatus int
+		Restarts       int
+	}
+
+	// A job runs a service to completion according to its schedule
+	job struct {
+		service  Service
+		schedule *cron.Schedule
+		stop     chan struct{}
+		onChange func(ServiceStatus)
+		// now and after are the clock, which tests replace
+		now   func() time.Time
+		after func(time.Duration) <-chan time.Time
+
+		mu      sync.Mutex
+		stopped bool
+		status  ServiceStatus
+	}
+)
+
+func newJob(service Service) (*job, error) {
+	schedule, err := cron.Parse(service.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	return &job{
+		service:  service,
+		schedule: schedule,
+		stop:     make(chan struct{}),
+		now:      time.Now,
+		after:    time.After,
+		status:   ServiceStatus{Schedule: service.Schedule},
+	}, nil
+}
+
+// Status returns the current status of the job
+func (j *job) Status() ServiceStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Stop stops scheduling the job and kills it if it's running
+func (j *job) Stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.stopped {
+		j.stopped = true
+		close(j.stop)
+	}
+	if j.status.Running {
+		kill(j.status.PID)
+	}
+}
+
+func (j *job) update(f func(*ServiceStatus)) {
+	j.mu.Lock()
+	f(&j.status)
+	status := j.status
+	j.mu.Unlock()
+	if j.onChange != nil {
+		j.onChange(status)
+	}
+}
+
+// loop runs the job at every scheduled time until it's stopped. If the
+// previous run hasn't finished the next one is skipped.
+func (j *job) loop() {
+	for {
+		now := j.now()
+		next := j.schedule.Next(now)
+		if next.IsZero() {
+			logging.Warn("schedule never runs", "service", j.service.Name, "schedule", j.service.Schedule)
+			return
+		}
+		select {
+		case <-j.after(next.Sub(now)):
+		case <-j.stop:
+			return
+		}
+
+		if j.Status().Running {
+			logging.Warn("still running, skipping", "service", j.service.Name, "scheduled", next)
+			continue
+		}
+		go j.run()
+	}
+}
+
+func (j *job) run() {
+	cmd, err := command(j.service)
+	if err == nil {
+		release, lerr := limitCommand(j.service.Name, cmd, j.service.Limits)
+		if lerr != nil {
+			logging.Warn("failed to apply limits", "service", j.service.Name, "error", lerr)
+		}
+		err = cmd.Start()
+		release()
+	}
+	if err != nil {
+		logging.Error("failed to start", "service", j.service.Name, "error", err)
+		j.update(func(status *ServiceStatus) {
+			status.LastRun = j.now()
+			status.LastExitStatus = -1
+		})
+		return
+	}
+
+	pid := cmd.Process.Pid
+	started := j.now()
+	j.update(func(status *ServiceStatus) {
+		status.Running = true
+		status.PID = pid
+		status.LastRun = started
+	})
+	logging.Info("started", "service", j.service.Name, "pid", pid)
+
+	err = cmd.Wait()
+	logging.Info("exited", "service", j.service.Name, "duration", j.now().Sub(started), "error", err)
+	exitStatus := 0
+	if err != nil {
+		exitStatus = -1
+		if ee, ok := err.(*exec.ExitError); ok {
+			exitStatus = ee.ExitCode()
+		}
+	}
+	j.update(func(status *ServiceStatus) {
+		status.Running = false
+		status.PID = 0
+		status.LastExitStatus = exitStatus
+	})
+}
+
+// RunScheduled runs a service on its schedule in the foreground, recording
+// its status in the given file after every change. It's used by service
+// managers without native support for scheduling.
+func RunScheduled(service Service, statusFile string) error {
+	if service.Environment == nil {
+		service.Environment = map[string]string{}
+		for _, e := range os.Environ() {
+			if i := strings.IndexByte(e, '='); i > 0 {
+				service.Environment[e[:i]] = e[i+1:]
+			}
+		}
+	}
+
+	j, err := newJob(service)
+	if err != nil {
+		return err
+	}
+	j.onChange = func(status ServiceStatus) {
+		bs, err := json.Marshal(status)
+		if err != nil {
+			return
+		}
+		ioutil.WriteFile(statusFile, bs, 0644)
+	}
+	j.onChange(j.Status())
+	j.loop()
+	return nil
+}
@@ -0,0 +1,135 @@
+package runner
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock only moves when the test sets it, and fires the job's timer when
+// the test says so
+type fakeClock struct {
+	mu    sync.Mutex
+	t     time.Time
+	waits chan time.Duration
+	fire  chan time.Time
+}
+
+func newFakeClock(t time.Time) *fakeClock {
+	return &fakeClock{
+		t:     t,
+		waits: make(chan time.Duration),
+		fire:  make(chan time.Time),
+	}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.fire
+}
+
+// wait returns the duration the job waits for next
+func (c *fakeClock) wait(t *testing.T) time.Duration {
+	select {
+	case d := <-c.waits:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the job to wait")
+	}
+	return 0
+}
+
+// advance moves the clock and fires the timer the job is waiting on
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	now := c.t
+	c.mu.Unlock()
+	c.fire <- now
+}
+
+func nextStatus(t *testing.T, statuses <-chan ServiceStatus) ServiceStatus {
+	select {
+	case status := <-statuses:
+		return status
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a status change")
+	}
+	return ServiceStatus{}
+}
+
+func testJob(t *testing.T, command []string, clock *fakeClock) (*job, <-chan ServiceStatus) {
+	j, err := newJob(Service{
+		Name:      "test",
+		Directory: os.TempDir(),
+		Command:   command,
+		Schedule:  "*/5 * * * *",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.now, j.after = clock.now, clock.after
+	statuses := make(chan ServiceStatus, 10)
+	j.onChange = func(status ServiceStatus) { statuses <- status }
+	return j, statuses
+}
+
+func TestJob(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2018, time.March, 14, 10, 2, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	j, statuses := testJob(t, []string{"/bin/sh", "-c", "exit 3"}, clock)
+	go j.loop()
+	defer j.Stop()
+
+	assert.Equal(3*time.Minute, clock.wait(t), "expected the job to wait for 10:05")
+	clock.advance(3 * time.Minute)
+
+	status := nextStatus(t, statuses)
+	assert.True(status.Running)
+	assert.NotZero(status.PID)
+	assert.Equal(start.Add(3*time.Minute), status.LastRun)
+
+	status = nextStatus(t, statuses)
+	assert.False(status.Running)
+	assert.Zero(status.PID)
+	assert.Equal(3, status.LastExitStatus)
+	assert.Equal("*/5 * * * *", status.Schedule)
+
+	assert.Equal(5*time.Minute, clock.wait(t), "expected the job to wait for 10:10")
+}
+
+func TestJobSkipsWhileRunning(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := newFakeClock(time.Date(2018, time.March, 14, 10, 0, 0, 0, time.UTC))
+	j, statuses := testJob(t, []string{"/bin/sleep", "60"}, clock)
+	go j.loop()
+
+	assert.Equal(5*time.Minute, clock.wait(t))
+	clock.advance(5 * time.Minute)
+	status := nextStatus(t, statuses)
+	assert.True(status.Running)
+	pid := status.PID
+
+	assert.Equal(5*time.Minute, clock.wait(t))
+	clock.advance(5 * time.Minute)
+	assert.Equal(5*time.Minute, clock.wait(t), "expected the run at 10:10 to be skipped")
+	assert.Equal(pid, j.Status().PID)
+	assert.Len(statuses, 0)
+
+	j.Stop()
+	status = nextStatus(t, statuses)
+	assert.False(status.Running)
+	assert.NotEqual(0, status.LastExitStatus, "expected the run to be killed")
+}
@@ -1,5 +1,7 @@
 package service
 
+import "time"
+
 type (
 	// A Service represent a long-lived application
 	Service struct {
@@ -7,12 +9,48 @@ type (
 		Directory   string
 		Command     []string
 		Environment map[string]string
+		Limits      Limits
+		// Schedule is a cron expression. Scheduled services are run to
+		// completion at the given times instead of being kept alive.
+		Schedule string
+		// Delegate lets the service manage the cgroups below its own, which
+		// the service runner needs to limit the services it starts. Only
+		// systemd supports it.
+		Delegate bool
+	}
+
+	// Limits restrict the resources available to a service
+	Limits struct {
+		// Memory is the maximum memory in bytes
+		Memory int64
+		// CPUQuota is the maximum CPU time as a percentage of a single CPU
+		CPUQuota int
+		// NoFile is the maximum number of open file descriptors
+		NoFile uint64
+	}
+
+	// Status is the current state of a service
+	Status struct {
+		Name     string
+		Running  bool
+		PID      int
+		Schedule string
+		// LastRun and LastExitStatus are only tracked for scheduled services
+		LastRun        time.Time
+		LastExitStatus int
+		// Restarts is the number of times the service was restarted after
+		// exiting, if the manager tracks it
+		Restarts int
 	}
 
 	// A Manager manages services
 	Manager interface {
+		// Check returns an error if the manager can't be used on this host.
+		// It doesn't change anything, so it's safe to call from any process.
+		Check() error
 		Install(service Service) error
 		Uninstall(serviceName string) error
 		List() ([]string, error)
+		Status(serviceName string) (Status, error)
 	}
 )
@@ -8,7 +8,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/badgerodon/stack/cron"
+	"github.com/badgerodon/stack/logging"
 )
 
 type (
@@ -37,33 +42,34 @@ func (mgr *SystemDManager) String() string {
 		mgr.unitFilePath, mgr.userMode)
 }
 
+// Check checks that systemctl and the unit file folder exist
+func (mgr *SystemDManager) Check() error {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return err
+	}
+	if _, err := os.Stat(mgr.unitFilePath); err != nil {
+		return err
+	}
+	return nil
+}
+
+var systemdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%")
+
 // Install installs the service
 func (mgr *SystemDManager) Install(service Service) error {
 	name := service.Name
 	dstPath := filepath.Join(mgr.unitFilePath, name+".service")
 	os.Remove(dstPath)
 
-	estr := ""
-	for k, v := range service.Environment {
-		estr += "\"" + k + "=" + v + "\" "
-	}
-
 	cmdName := getCommand(service)
 	os.Chmod(cmdName, 0777)
 
-	err := ioutil.WriteFile(dstPath, []byte(`
-[Unit]
-Description=`+service.Name+`
-
-[Service]
-Environment=`+estr+`
-ExecStart=`+cmdName+` `+strings.Join(service.Command[1:], " ")+`
-WorkingDirectory=`+service.Directory+`
-Restart=always
+	if service.Schedule != "" {
+		return mgr.installScheduled(service, cmdName)
+	}
 
-[Install]
-WantedBy=multi-user.target
-  `), 0644)
+	logging.Debug("write unit", "service", name, "path", dstPath)
+	err := ioutil.WriteFile(dstPath, []byte(systemdUnit(service, cmdName)), 0600)
 	if err != nil {
 		return err
 	}
@@ -90,20 +96,22 @@ func (mgr *SystemDManager) List() ([]string, error) {
 	}
 	scanner := bufio.NewScanner(bytes.NewReader(out))
 	services := []string{}
-	i := 0
+	seen := map[string]struct{}{}
 	for scanner.Scan() {
-		if i > 0 {
-			fs := strings.Fields(scanner.Text())
-			if len(fs) == 0 {
-				break
-			}
-			n := fs[0]
-			if strings.Contains(n, ".") {
-				n = n[:strings.Index(n, ".")]
-			}
-			services = append(services, n)
+		fs := strings.Fields(scanner.Text())
+		if len(fs) == 0 {
+			break
+		}
+		n := fs[0]
+		if strings.Contains(n, ".") {
+			n = n[:strings.Index(n, ".")]
+		}
+		// scheduled services have both a .service and a .timer unit
+		if _, ok := seen[n]; ok {
+			continue
 		}
-		i++
+		seen[n] = struct{}{}
+		services = append(services, n)
 	}
 	return services, nil
 }
@@ -111,9 +119,202 @@ func (mgr *SystemDManager) List() ([]string, error) {
 // Uninstall uninstall a service
 func (mgr *SystemDManager) Uninstall(name string) error {
 	dstPath := filepath.Join(mgr.unitFilePath, name+".service")
+	timerPath := filepath.Join(mgr.unitFilePath, name+".timer")
+	if _, err := os.Stat(timerPath); err == nil {
+		logging.Debug("remove timer", "service", name, "path", timerPath)
+		exec.Command("systemctl", mgr.mode(), "disable", name+".timer").Run()
+		exec.Command("systemctl", mgr.mode(), "stop", name+".timer").Run()
+		os.Remove(timerPath)
+	}
 	exec.Command("systemctl", mgr.mode(), "disable", name).Run()
 	exec.Command("systemctl", mgr.mode(), "stop", name).Run()
 	os.Remove(dstPath)
 	exec.Command("systemctl", mgr.mode(), "daemon-reload").Run()
 	return nil
 }
+
+// installScheduled installs a oneshot service along with a timer that
+// triggers it according to the service's schedule
+func (mgr *SystemDManager) installScheduled(service Service, cmdName string) error {
+	name := service.Name
+	timer, err := systemdTimer(service)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(mgr.unitFilePath, name+".service"), []byte(systemdUnit(service, cmdName)), 0600)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug("write timer", "service", name, "schedule", service.Schedule)
+	err = ioutil.WriteFile(filepath.Join(mgr.unitFilePath, name+".timer"), []byte(timer), 0644)
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command("systemctl", mgr.mode(), "daemon-reload").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error reloading daemon: %v", string(out))
+	}
+	out, err = exec.Command("systemctl", mgr.mode(), "start", name+".timer").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error starting timer: %v", string(out))
+	}
+	out, err = exec.Command("systemctl", mgr.mode(), "enable", name+".timer").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error enabling timer: %v", string(out))
+	}
+	return nil
+}
+
+// systemdUnit returns the unit file for a service. Scheduled services are
+// oneshot units, which are started by a timer instead of being restarted.
+func systemdUnit(service Service, cmdName string) string {
+	estr := ""
+	for k, v := range service.Environment {
+		estr += "\"" + systemdEscaper.Replace(k+"="+v) + "\" "
+	}
+
+	lstr := ""
+	if service.Limits.Memory > 0 {
+		lstr += fmt.Sprintf("MemoryMax=%d\n", service.Limits.Memory)
+	}
+	if service.Limits.CPUQuota > 0 {
+		lstr += fmt.Sprintf("CPUQuota=%d%%\n", service.Limits.CPUQuota)
+	}
+	if service.Limits.NoFile > 0 {
+		lstr += fmt.Sprintf("LimitNOFILE=%d\n", service.Limits.NoFile)
+	}
+	if service.Delegate {
+		lstr += "Delegate=yes\n"
+	}
+
+	if service.Schedule != "" {
+		return `
+[Unit]
+Description=` + service.Name + `
+
+[Service]
+Type=oneshot
+Environment=` + estr + `
+ExecStart=` + cmdName + ` ` + strings.Join(service.Command[1:], " ") + `
+WorkingDirectory=` + service.Directory + `
+` + lstr + `
+  `
+	}
+
+	return `
+[Unit]
+Description=` + service.Name + `
+
+[Service]
+Environment=` + estr + `
+ExecStart=` + cmdName + ` ` + strings.Join(service.Command[1:], " ") + `
+WorkingDirectory=` + service.Directory + `
+Restart=always
+` + lstr + `
+[Install]
+WantedBy=multi-user.target
+  `
+}
+
+// systemdTimer returns the timer unit which starts a scheduled service
+func systemdTimer(service Service) (string, error) {
+	calendars, err := onCalendar(service.Schedule)
+	if err != nil {
+		return "", err
+	}
+
+	cstr := ""
+	for _, calendar := range calendars {
+		cstr += "OnCalendar=" + calendar + "\n"
+	}
+	return `
+# schedule: ` + service.Schedule + `
+[Unit]
+Description=` + service.Name + ` timer
+
+[Timer]
+` + cstr + `
+[Install]
+WantedBy=timers.target
+  `, nil
+}
+
+// Status returns the status of a service
+func (mgr *SystemDManager) Status(name string) (Status, error) {
+	out, err := exec.Command("systemctl", mgr.mode(), "show", name+".service",
+		"--property=ActiveState,MainPID,ExecMainStartTimestamp,ExecMainStatus,NRestarts").CombinedOutput()
+	if err != nil {
+		return Status{}, fmt.Errorf("error getting service status: %v", string(out))
+	}
+	props := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 {
+			props[kv[0]] = kv[1]
+		}
+	}
+
+	status := Status{Name: name}
+	// a running oneshot service is still activating
+	status.Running = props["ActiveState"] == "active" || props["ActiveState"] == "activating"
+	status.PID, _ = strconv.Atoi(props["MainPID"])
+	status.Restarts, _ = strconv.Atoi(props["NRestarts"])
+
+	bs, err := ioutil.ReadFile(filepath.Join(mgr.unitFilePath, name+".timer"))
+	if err == nil {
+		for _, line := range strings.Split(string(bs), "\n") {
+			if strings.HasPrefix(line, "# schedule: ") {
+				status.Schedule = strings.TrimPrefix(line, "# schedule: ")
+			}
+		}
+		status.LastRun, _ = time.Parse("Mon 2006-01-02 15:04:05 MST", props["ExecMainStartTimestamp"])
+		status.LastExitStatus, _ = strconv.Atoi(props["ExecMainStatus"])
+	}
+
+	return status, nil
+}
+
+func calendarField(f cron.Field) string {
+	if f.Any() {
+		return "*"
+	}
+	var strs []string
+	for _, v := range f.Values() {
+		strs = append(strs, fmt.Sprintf("%02d", v))
+	}
+	return strings.Join(strs, ",")
+}
+
+var calendarWeekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// onCalendar converts a cron expression into systemd calendar events
+func onCalendar(spec string) ([]string, error) {
+	s, err := cron.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	tm := calendarField(s.Hour) + ":" + calendarField(s.Minute) + ":00"
+	month := calendarField(s.Month)
+	var weekdays []string
+	for _, v := range s.Weekday.Values() {
+		weekdays = append(weekdays, calendarWeekdays[v])
+	}
+
+	switch {
+	case s.Weekday.Any():
+		return []string{"*-" + month + "-" + calendarField(s.Day) + " " + tm}, nil
+	case s.Day.Any():
+		return []string{strings.Join(weekdays, ",") + " *-" + month + "-* " + tm}, nil
+	}
+	// cron runs when either the day of month or the day of week matches, but
+	// systemd requires both, so use separate events
+	return []string{
+		"*-" + month + "-" + calendarField(s.Day) + " " + tm,
+		strings.Join(weekdays, ",") + " *-" + month + "-* " + tm,
+	}, nil
+}
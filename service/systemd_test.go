@@ -0,0 +1,85 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdUnit(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := Service{
+		Name:      "stack-app",
+		Directory: "/opt/stack/applications/app",
+		Command:   []string{"app", "--port", "8080"},
+		Limits: Limits{
+			Memory:   512 * 1024 * 1024,
+			CPUQuota: 50,
+			NoFile:   4096,
+		},
+	}
+	unit := systemdUnit(svc, "/opt/stack/applications/app/app")
+	lines := strings.Split(unit, "\n")
+	assert.Contains(lines, "ExecStart=/opt/stack/applications/app/app --port 8080")
+	assert.Contains(lines, "Restart=always")
+	assert.Contains(lines, "MemoryMax=536870912")
+	assert.Contains(lines, "CPUQuota=50%")
+	assert.Contains(lines, "LimitNOFILE=4096")
+	assert.NotContains(lines, "Delegate=yes")
+
+	svc.Schedule = "0 3 * * *"
+	unit = systemdUnit(svc, "/opt/stack/applications/app/app")
+	lines = strings.Split(unit, "\n")
+	assert.Contains(lines, "Type=oneshot")
+	assert.NotContains(lines, "Restart=always")
+	assert.Contains(lines, "MemoryMax=536870912")
+	assert.Contains(lines, "CPUQuota=50%")
+	assert.Contains(lines, "LimitNOFILE=4096")
+
+	unit = systemdUnit(Service{
+		Name:     "stack",
+		Command:  []string{"/opt/stack/stack", "watch"},
+		Delegate: true,
+	}, "/opt/stack/stack")
+	lines = strings.Split(unit, "\n")
+	assert.Contains(lines, "Delegate=yes")
+	assert.NotContains(unit, "MemoryMax")
+}
+
+func TestOnCalendar(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		spec   string
+		expect []string
+	}{
+		{"* * * * *", []string{"*-*-* *:*:00"}},
+		{"*/15 * * * *", []string{"*-*-* *:00,15,30,45:00"}},
+		{"0 3 * * *", []string{"*-*-* 03:00:00"}},
+		{"30 2 1 * *", []string{"*-*-01 02:30:00"}},
+		{"0 0-6,22 * jan-mar *", []string{"*-01,02,03-* 00,01,02,03,04,05,06,22:00:00"}},
+		{"0 9 * * mon-fri", []string{"Mon,Tue,Wed,Thu,Fri *-*-* 09:00:00"}},
+		{"0 0 * * 7", []string{"Sun *-*-* 00:00:00"}},
+		{"@monthly", []string{"*-*-01 00:00:00"}},
+		// cron runs when either day matches
+		{"0 12 15 * sun", []string{"*-*-15 12:00:00", "Sun *-*-* 12:00:00"}},
+	}
+	for _, tc := range cases {
+		calendars, err := onCalendar(tc.spec)
+		if assert.Nil(err, tc.spec) {
+			assert.Equal(tc.expect, calendars, tc.spec)
+		}
+	}
+
+	_, err := onCalendar("60 * * * *")
+	assert.Error(err)
+
+	timer, err := systemdTimer(Service{Name: "stack-app", Schedule: "0 12 15 * sun"})
+	assert.Nil(err)
+	lines := strings.Split(timer, "\n")
+	assert.Contains(lines, "# schedule: 0 12 15 * sun")
+	assert.Contains(lines, "OnCalendar=*-*-15 12:00:00")
+	assert.Contains(lines, "OnCalendar=Sun *-*-* 12:00:00")
+}
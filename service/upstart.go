@@ -3,44 +3,78 @@ package service
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/badgerodon/stack/logging"
+	"github.com/badgerodon/stack/service/runner"
+	"github.com/kardianos/osext"
 )
 
 type UpstartServiceManager struct {
+	statusDir string
+}
+
+// NewUpstartServiceManager creates a new upstart service manager. Upstart
+// has no support for scheduling, so scheduled services are run by the stack
+// itself and record their status in statusDir.
+func NewUpstartServiceManager(statusDir string) *UpstartServiceManager {
+	return &UpstartServiceManager{statusDir: statusDir}
+}
+
+// Check checks that initctl and the job folder exist
+func (usm *UpstartServiceManager) Check() error {
+	if _, err := exec.LookPath("initctl"); err != nil {
+		return err
+	}
+	if _, err := os.Stat("/etc/init"); err != nil {
+		return err
+	}
+	return nil
 }
 
-func NewUpstartServiceManager() *UpstartServiceManager {
-	return &UpstartServiceManager{}
+func (usm *UpstartServiceManager) statusFile(name string) string {
+	return filepath.Join(usm.statusDir, name+".status")
+}
+
+var upstartEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func quoteUpstart(arg string) string {
+	return "'" + strings.Replace(arg, "'", "\\'", -1) + "'"
 }
 
 func (usm *UpstartServiceManager) Install(service Service) error {
 	cmdName := getCommand(service)
 	os.Chmod(cmdName, 0777)
 
-	src := `
-description "` + service.Name + `"
-
-start on (started networking)
-respawn
-
-chdir ` + service.Directory + `
-`
-	for k, v := range service.Environment {
-		src += k + "=" + v + "\n"
+	command := append([]string{cmdName}, service.Command[1:]...)
+	if service.Schedule != "" {
+		exe, err := osext.Executable()
+		if err != nil {
+			return err
+		}
+		command = append([]string{
+			exe, "run-scheduled",
+			"--name", service.Name,
+			"--schedule", service.Schedule,
+			"--status-file", usm.statusFile(service.Name),
+			"--",
+		}, command...)
 	}
 
-	src += "exec " + cmdName
-	for _, arg := range service.Command[1:] {
-		src += " '" + strings.Replace(arg, "'", "\\'", -1) + "'"
+	if service.Limits.CPUQuota > 0 {
+		logging.Warn("upstart doesn't support cpu quotas, ignoring it", "service", service.Name, "cpu_quota", service.Limits.CPUQuota)
 	}
-	src += "\n"
 
-	err := ioutil.WriteFile("/etc/init/"+service.Name+".conf", []byte(src), 0644)
+	logging.Debug("write job", "service", service.Name, "path", "/etc/init/"+service.Name+".conf")
+	err := ioutil.WriteFile("/etc/init/"+service.Name+".conf", []byte(upstartJob(service, command)), 0600)
 	if err != nil {
 		return err
 	}
@@ -48,6 +82,7 @@ chdir ` + service.Directory + `
 	bs, err := exec.Command("initctl", "start", service.Name).CombinedOutput()
 	if err != nil {
 		if strings.Contains(string(bs), "already running") {
+			logging.Info("restart service", "service", service.Name)
 			exec.Command("initctl", "stop", service.Name).Run()
 			time.Sleep(10 * time.Second)
 			bs, err = exec.Command("initctl", "start", service.Name).CombinedOutput()
@@ -60,13 +95,45 @@ chdir ` + service.Directory + `
 	return nil
 }
 
+// upstartJob returns the job configuration which runs the command for a
+// service
+func upstartJob(service Service, command []string) string {
+	src := `
+description "` + service.Name + `"
+
+start on (started networking)
+respawn
+
+chdir ` + service.Directory + `
+`
+	for k, v := range service.Environment {
+		src += "env " + k + "=\"" + upstartEscaper.Replace(v) + "\"\n"
+	}
+
+	// upstart only supports rlimits, so there's no equivalent to a cpu quota
+	if service.Limits.Memory > 0 {
+		src += fmt.Sprintf("limit as %d %d\n", service.Limits.Memory, service.Limits.Memory)
+	}
+	if service.Limits.NoFile > 0 {
+		src += fmt.Sprintf("limit nofile %d %d\n", service.Limits.NoFile, service.Limits.NoFile)
+	}
+
+	src += "exec " + command[0]
+	for _, arg := range command[1:] {
+		src += " " + quoteUpstart(arg)
+	}
+	src += "\n"
+	return src
+}
+
 func (usm *UpstartServiceManager) Uninstall(name string) error {
 	os.Remove("/etc/init/" + name + ".conf")
+	os.Remove(usm.statusFile(name))
 	bs, err := exec.Command("initctl", "stop", name).CombinedOutput()
-	if err != nil {
+	if err != nil && !strings.Contains(string(bs), "Unknown instance") && !strings.Contains(string(bs), "Unknown job") {
 		return fmt.Errorf("failed to stop service: %v", string(bs))
 	}
-	return fmt.Errorf("not implemented")
+	return nil
 }
 
 func (usm *UpstartServiceManager) List() ([]string, error) {
@@ -81,9 +148,41 @@ func (usm *UpstartServiceManager) List() ([]string, error) {
 		if len(fs) < 2 {
 			continue
 		}
-		if strings.HasPrefix(fs[0], "badgerodon-stack-") && strings.Contains(fs[1], "running") {
+		if strings.HasPrefix(fs[0], "stack-") && strings.Contains(fs[1], "running") {
 			services = append(services, fs[0])
 		}
 	}
 	return services, nil
 }
+
+func (usm *UpstartServiceManager) Status(name string) (Status, error) {
+	out, err := exec.Command("initctl", "status", name).CombinedOutput()
+	if err != nil {
+		return Status{}, fmt.Errorf("error getting service status: %v", string(out))
+	}
+	status := Status{Name: name}
+	// ie: stack-example start/running, process 1234
+	fs := strings.Fields(string(out))
+	for i, f := range fs {
+		if strings.HasPrefix(f, "start/running") {
+			status.Running = true
+		}
+		if f == "process" && i+1 < len(fs) {
+			status.PID, _ = strconv.Atoi(fs[i+1])
+		}
+	}
+
+	// scheduled services report the status of the job, not the scheduler
+	bs, err := ioutil.ReadFile(usm.statusFile(name))
+	if err == nil {
+		var js runner.ServiceStatus
+		if json.Unmarshal(bs, &js) == nil {
+			status.Running = js.Running
+			status.PID = js.PID
+			status.Schedule = js.Schedule
+			status.LastRun = js.LastRun
+			status.LastExitStatus = js.LastExitStatus
+		}
+	}
+	return status, nil
+}
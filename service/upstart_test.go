@@ -0,0 +1,33 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstartJob(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := Service{
+		Name:      "stack-app",
+		Directory: "/opt/stack/applications/app",
+		Command:   []string{"app", "--name", "it's"},
+		Limits: Limits{
+			Memory:   512 * 1024 * 1024,
+			CPUQuota: 50,
+			NoFile:   4096,
+		},
+	}
+	job := upstartJob(svc, []string{"/opt/stack/applications/app/app", "--name", "it's"})
+	lines := strings.Split(job, "\n")
+	assert.Contains(lines, "chdir /opt/stack/applications/app")
+	assert.Contains(lines, "limit as 536870912 536870912")
+	assert.Contains(lines, "limit nofile 4096 4096")
+	assert.Contains(lines, `exec /opt/stack/applications/app/app '--name' 'it\'s'`)
+	assert.NotContains(job, "cpu")
+
+	job = upstartJob(Service{Name: "stack-app"}, []string{"app"})
+	assert.NotContains(job, "limit")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/badgerodon/stack/service"
+)
+
+// A serviceStatus is the status of a service, or the error getting it
+type serviceStatus struct {
+	service.Status
+	Error string `json:",omitempty"`
+}
+
+// serviceStatuses returns the status of every installed service
+func serviceStatuses() ([]serviceStatus, error) {
+	names, err := serviceManager.List()
+	if err != nil {
+		return nil, err
+	}
+	services := make([]serviceStatus, 0, len(names))
+	for _, name := range names {
+		st, err := serviceManager.Status(name)
+		if err != nil {
+			services = append(services, serviceStatus{Status: service.Status{Name: name}, Error: err.Error()})
+			continue
+		}
+		st.Name = name
+		services = append(services, serviceStatus{Status: st})
+	}
+	return services, nil
+}
+
+// status prints the status of every service managed by the stack
+func status() error {
+	running := daemonRunning()
+	if running {
+		var ds DaemonStatus
+		err := callDaemon("GET", "/status", &ds)
+		if err != nil {
+			return err
+		}
+		state := "watching"
+		switch {
+		case ds.Applying:
+			state = "applying"
+		case ds.Paused:
+			state = "paused"
+		}
+		fmt.Printf("daemon: %s (%s)\n", state, ds.Source)
+		if ds.Pending {
+			when := "when resumed"
+			if !ds.Paused && !ds.NextWindow.IsZero() {
+				when = "when the maintenance window opens at " + ds.NextWindow.Format(time.RFC3339)
+			}
+			fmt.Printf("pending: since %s, will be applied %s\n", ds.PendingSince.Format(time.RFC3339), when)
+			for _, change := range ds.Changes {
+				fmt.Printf("  %s\n", change)
+			}
+		}
+		if !ds.LastApply.IsZero() {
+			fmt.Printf("last apply: %s\n", ds.LastApply.Format(time.RFC3339))
+		}
+		if ds.Version != "" {
+			fmt.Printf("version: %s\n", ds.Version)
+		}
+		if ds.LastError != "" {
+			fmt.Printf("last error: %s (%s)\n", ds.LastError, ds.LastErrorTime.Format(time.RFC3339))
+		}
+		if r := ds.Retry; r != nil {
+			if r.GaveUp {
+				fmt.Printf("retry: gave up on %s after %d attempts\n", r.Version, r.Attempts)
+			} else {
+				fmt.Printf("retry: %s attempt %d failed, next retry at %s\n", r.Version, r.Attempts, r.NextRetry.Format(time.RFC3339))
+			}
+		}
+		fmt.Println()
+	}
+
+	// the local service manager would start a second runner next to the
+	// daemon's, so the daemon is asked when it's running
+	var services []serviceStatus
+	var err error
+	if running {
+		err = callDaemon("GET", "/services", &services)
+	} else {
+		services, err = serviceStatuses()
+	}
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tSTATE\tPID\tSCHEDULE\tLAST RUN\tLAST EXIT")
+	for _, st := range services {
+		name := st.Name
+		if st.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\t\t\t\t\n", name, st.Error)
+			continue
+		}
+
+		state, pid := "stopped", ""
+		if st.Running {
+			state, pid = "running", strconv.Itoa(st.PID)
+		}
+		lastRun, lastExit := "", ""
+		if !st.LastRun.IsZero() {
+			lastRun = st.LastRun.Format(time.RFC3339)
+			lastExit = strconv.Itoa(st.LastExitStatus)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", name, state, pid, st.Schedule, lastRun, lastExit)
+	}
+	return w.Flush()
+}
@@ -1,24 +1,442 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
 )
 
-// azure://container_name
+// azure://[{account}[.blob.core.windows.net]/]{container}/{path}
 
 type (
-	AzureProvider byte
+	AzureProvider struct {
+		client *http.Client
+	}
+
+	azureref struct {
+		account, container, blob string
+		// key is the decoded shared key
+		key []byte
+		// sas is a shared access signature query string
+		sas string
+		// endpoint is the blob service, ie an emulator
+		endpoint *url.URL
+	}
+
+	// azureError is an error response from Azure Storage
+	azureError struct {
+		StatusCode int    `xml:"-"`
+		Code       string `xml:"Code"`
+		Message    string `xml:"Message"`
+	}
+
+	azureListResult struct {
+		Blobs struct {
+			Blob []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blob"`
+			BlobPrefix []struct {
+				Name string `xml:"Name"`
+			} `xml:"BlobPrefix"`
+		} `xml:"Blobs"`
+		NextMarker string `xml:"NextMarker"`
+	}
+
+	azureBlockList struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}
+)
+
+var Azure = &AzureProvider{client: http.DefaultClient}
+
+var (
+	// files larger than this are uploaded in blocks
+	azureBlockSize = 4 << 20
+)
+
+const (
+	azureVersion = "2020-04-08"
+	azureDomain  = ".blob.core.windows.net"
 )
 
-func (az AzureProvider) Get(rawurl string) (io.ReadCloser, error) {
-	return nil, fmt.Errorf("not implemented")
+func init() {
+	Register("azure", Azure)
+}
+
+func (err azureError) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("azure error: %d %s", err.StatusCode, http.StatusText(err.StatusCode))
+	}
+	return fmt.Sprintf("azure error: %s: %s", err.Code, strings.SplitN(err.Message, "\n", 2)[0])
+}
+
+func (az *AzureProvider) parse(loc Location) (azureref, error) {
+	ref := azureref{
+		account:   loc["account"],
+		container: loc["container"],
+		blob:      strings.TrimPrefix(loc.Path(), "/"),
+	}
+	host := loc.Host()
+	if ref.account == "" {
+		ref.account = os.Getenv("AZURE_ACCOUNT")
+	}
+
+	switch {
+	case strings.HasSuffix(host, azureDomain):
+		ref.account = strings.TrimSuffix(host, azureDomain)
+	case host != "" && ref.account == "":
+		ref.account = host
+	case host != "":
+		// azure://{container}/{path}
+		if ref.container == "" {
+			ref.container = host
+		} else {
+			ref.blob = path.Join(host, ref.blob)
+		}
+	}
+	if ref.container == "" && host != "" {
+		if i := strings.Index(ref.blob, "/"); i >= 0 {
+			ref.container, ref.blob = ref.blob[:i], ref.blob[i+1:]
+		} else {
+			ref.container, ref.blob = ref.blob, ""
+		}
+	}
+	if ref.container == "" {
+		ref.container = os.Getenv("AZURE_CONTAINER")
+	}
+	if ref.account == "" || ref.container == "" {
+		return ref, fmt.Errorf("azure account and container are required")
+	}
+
+	// credentials
+	key := loc["key"]
+	if key == "" {
+		key = loc["password"]
+	}
+	if key == "" {
+		key = os.Getenv("AZURE_KEY")
+	}
+	if key != "" {
+		var err error
+		ref.key, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return ref, fmt.Errorf("invalid azure key: %v", err)
+		}
+	}
+	ref.sas = loc["sas"]
+	if ref.sas == "" && loc.Query().Get("sig") != "" {
+		ref.sas = loc["query"]
+	}
+	if ref.sas == "" {
+		ref.sas = os.Getenv("AZURE_SAS")
+	}
+	ref.sas = strings.TrimPrefix(ref.sas, "?")
+
+	endpoint := loc["endpoint"]
+	if endpoint == "" {
+		endpoint = os.Getenv("AZURE_ENDPOINT")
+	}
+	if endpoint == "" {
+		endpoint = "https://" + ref.account + azureDomain
+	}
+	var err error
+	ref.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || ref.endpoint.Host == "" {
+		return ref, fmt.Errorf("invalid azure endpoint %s", endpoint)
+	}
+	return ref, nil
+}
+
+func (ref azureref) String() string {
+	return "azure://" + ref.account + "/" + ref.container + "/" + ref.blob
+}
+
+// url returns the url of a blob in the container, or of the container if
+// blob is empty
+func (ref azureref) url(blob string, query url.Values) *url.URL {
+	u := *ref.endpoint
+	u.Path += "/" + ref.container
+	if blob != "" {
+		u.Path += "/" + blob
+	}
+	u.RawPath = s3Escape(u.Path, false)
+
+	q := url.Values{}
+	if ref.key == nil && ref.sas != "" {
+		q, _ = url.ParseQuery(ref.sas)
+	}
+	for k, vs := range query {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+	return &u
+}
+
+func (az *AzureProvider) do(ref azureref, method, blob string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, ref.url(blob, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = nil
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if ref.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+ref.account+":"+azureSignature(ref.account, ref.key, req))
+	}
+
+	res, err := az.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+
+	azerr := azureError{StatusCode: res.StatusCode}
+	bs, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	xml.Unmarshal(bs, &azerr)
+	if azerr.Code == "" {
+		azerr.Code = res.Header.Get("x-ms-error-code")
+	}
+	if res.StatusCode == 404 && azerr.Code != "ContainerNotFound" {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: ref.String(), Err: os.ErrNotExist}
+	}
+	return nil, azerr
+}
+
+func (az *AzureProvider) Delete(loc Location) error {
+	ref, err := az.parse(loc)
+	if err != nil {
+		return err
+	}
+	res, err := az.do(ref, "DELETE", ref.blob, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (az *AzureProvider) Get(loc Location) (io.ReadCloser, error) {
+	ref, err := az.parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	res, err := az.do(ref, "GET", ref.blob, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
 }
 
-func (az AzureProvider) Put(rawurl string, rdr io.Reader) error {
-	return fmt.Errorf("not implemented")
+func (az *AzureProvider) Put(loc Location, rdr io.Reader) error {
+	ref, err := az.parse(loc)
+	if err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(path.Ext(ref.blob))
+
+	buf := make([]byte, azureBlockSize)
+	n, err := io.ReadFull(rdr, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		header := http.Header{"X-Ms-Blob-Type": {"BlockBlob"}}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		res, err := az.do(ref, "PUT", ref.blob, nil, header, buf[:n])
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// large files are uploaded in blocks, which are committed at the end
+	var blocks azureBlockList
+	block := buf
+	for {
+		// block ids must all have the same length
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(blocks.Latest))))
+		res, err := az.do(ref, "PUT", ref.blob, url.Values{"comp": {"block"}, "blockid": {id}}, nil, block)
+		if err != nil {
+			return fmt.Errorf("error uploading block %d: %v", len(blocks.Latest), err)
+		}
+		res.Body.Close()
+		blocks.Latest = append(blocks.Latest, id)
+
+		n, err := io.ReadFull(rdr, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		block = buf[:n]
+	}
+
+	body, _ := xml.Marshal(blocks)
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("X-Ms-Blob-Content-Type", contentType)
+	}
+	res, err := az.do(ref, "PUT", ref.blob, url.Values{"comp": {"blocklist"}}, header, append([]byte(xml.Header), body...))
+	if err != nil {
+		return fmt.Errorf("error committing blocks: %v", err)
+	}
+	res.Body.Close()
+	return nil
 }
 
-func (az AzureProvider) List(rawurl string) ([]string, error) {
-	return nil, fmt.Errorf("not implemented")
+func (az *AzureProvider) List(loc Location) ([]string, error) {
+	ref, err := az.parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ref.blob
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	names := []string{}
+	marker := ""
+	for {
+		query := url.Values{
+			"restype":   {"container"},
+			"comp":      {"list"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		res, err := az.do(ref, "GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result azureListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid list response: %v", err)
+		}
+		for _, p := range result.Blobs.BlobPrefix {
+			names = append(names, strings.TrimPrefix(p.Name, prefix))
+		}
+		for _, b := range result.Blobs.Blob {
+			names = append(names, strings.TrimPrefix(b.Name, prefix))
+		}
+		if result.NextMarker == "" {
+			break
+		}
+		marker = result.NextMarker
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (az *AzureProvider) head(loc Location) (*http.Response, error) {
+	ref, err := az.parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	res, err := az.do(ref, "HEAD", ref.blob, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res, nil
+}
+
+func (az *AzureProvider) Version(loc Location, previous string) (string, error) {
+	res, err := az.head(loc)
+	if err != nil {
+		return "", err
+	}
+	return res.Header.Get("ETag"), nil
+}
+
+func (az *AzureProvider) Stat(loc Location) (FileInfo, error) {
+	res, err := az.head(loc)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi := FileInfo{Size: -1}
+	if res.ContentLength >= 0 {
+		fi.Size = res.ContentLength
+	}
+	fi.ModTime, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	// blobs uploaded in blocks don't have an md5
+	if md5, err := base64.StdEncoding.DecodeString(res.Header.Get("Content-MD5")); err == nil && len(md5) == 16 {
+		fi.Hash = hex.EncodeToString(md5)
+	}
+	return fi, nil
+}
+
+// azureSignature computes the SharedKey signature of a request
+func azureSignature(account string, key []byte, req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = fmt.Sprint(req.ContentLength)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(req.Method + "\n")
+	for _, h := range []string{"Content-Encoding", "Content-Language"} {
+		buf.WriteString(req.Header.Get(h) + "\n")
+	}
+	buf.WriteString(contentLength + "\n")
+	for _, h := range []string{"Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		buf.WriteString(req.Header.Get(h) + "\n")
+	}
+
+	var headers []string
+	for k := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			headers = append(headers, k)
+		}
+	}
+	sort.Strings(headers)
+	for _, k := range headers {
+		buf.WriteString(k + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n")
+	}
+
+	buf.WriteString("/" + account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	var params []string
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		vs := query[k]
+		sort.Strings(vs)
+		buf.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(vs, ","))
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf.Bytes())
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the well known development storage account
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+func TestAzureParse(t *testing.T) {
+	defer os.Setenv("AZURE_ACCOUNT", os.Getenv("AZURE_ACCOUNT"))
+	defer os.Setenv("AZURE_CONTAINER", os.Getenv("AZURE_CONTAINER"))
+	os.Unsetenv("AZURE_ACCOUNT")
+	os.Unsetenv("AZURE_CONTAINER")
+
+	var az AzureProvider
+	cases := []struct {
+		location, account, container, blob, url string
+	}{
+		{"azure://acct.blob.core.windows.net/releases/a/b.tgz", "acct", "releases", "a/b.tgz", "https://acct.blob.core.windows.net/releases/a/b.tgz"},
+		{"azure://acct/releases/a b.tgz", "acct", "releases", "a b.tgz", "https://acct.blob.core.windows.net/releases/a%20b.tgz"},
+		{"azure://acct/releases", "acct", "releases", "", "https://acct.blob.core.windows.net/releases"},
+		{"azure://acct/releases/a.tgz?sv=2020-04-08&sig=abc", "acct", "releases", "a.tgz", "https://acct.blob.core.windows.net/releases/a.tgz?sig=abc&sv=2020-04-08"},
+	}
+	for _, c := range cases {
+		loc, _ := ParseLocation(c.location)
+		ref, err := az.parse(loc)
+		if assert.Nil(t, err, c.location) {
+			assert.Equal(t, c.account, ref.account, c.location)
+			assert.Equal(t, c.container, ref.container, c.location)
+			assert.Equal(t, c.blob, ref.blob, c.location)
+			assert.Equal(t, c.url, ref.url(ref.blob, nil).String(), c.location)
+		}
+	}
+
+	// defaults from the environment
+	os.Setenv("AZURE_ACCOUNT", "acct")
+	loc, _ := ParseLocation("azure://releases/a/b.tgz")
+	ref, err := az.parse(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, "acct", ref.account)
+	assert.Equal(t, "releases", ref.container)
+	assert.Equal(t, "a/b.tgz", ref.blob)
+
+	os.Setenv("AZURE_CONTAINER", "releases")
+	ref, err = az.parse(Location{"type": "azure", "path": "a/b.tgz", "endpoint": "http://127.0.0.1:10000/acct"})
+	assert.Nil(t, err)
+	assert.Equal(t, "releases", ref.container)
+	assert.Equal(t, "http://127.0.0.1:10000/acct/releases/a/b.tgz", ref.url(ref.blob, nil).String())
+
+	os.Unsetenv("AZURE_ACCOUNT")
+	_, err = az.parse(Location{"type": "azure", "path": "a/b.tgz"})
+	assert.NotNil(t, err)
+	_, err = az.parse(Location{"type": "azure", "host": "acct", "path": "/releases/a", "key": "not base64!"})
+	assert.NotNil(t, err)
+}
+
+// the string to sign from the Azure documentation's Get Container Metadata
+// example and a blob upload, signed with the development storage key
+func TestAzureSignature(t *testing.T) {
+	key, _ := base64.StdEncoding.DecodeString(azuriteKey)
+
+	req, _ := http.NewRequest("GET", "https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=metadata&timeout=20", nil)
+	req.Header.Set("x-ms-date", "Fri, 26 Jun 2015 23:39:12 GMT")
+	req.Header.Set("x-ms-version", "2015-02-21")
+	assert.Equal(t, "1u9lui2jDxj0+fpbHjQ5m5NnastJRSYM+PSmfi8TXx4=", azureSignature("myaccount", key, req))
+
+	req, _ = http.NewRequest("PUT", "https://myaccount.blob.core.windows.net/mycontainer/a%20b.txt", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-date", "Fri, 26 Jun 2015 23:39:12 GMT")
+	req.Header.Set("x-ms-version", "2020-04-08")
+	assert.Equal(t, "JpG3m0XciRlSrC4+tAi/alSfPAGTv1U83pRUFEIDewg=", azureSignature("myaccount", key, req))
+}
+
+// fakeAzurite is an in-memory blob service like the Azurite emulator
+type fakeAzurite struct {
+	fakeBucket
+	key    []byte
+	sas    string
+	md5s   map[string]string
+	blocks map[string]map[string][]byte
+	puts   int
+}
+
+func newFakeAzurite() *fakeAzurite {
+	key, _ := base64.StdEncoding.DecodeString(azuriteKey)
+	f := &fakeAzurite{
+		key:    key,
+		sas:    "fakesig",
+		md5s:   map[string]string{},
+		blocks: map[string]map[string][]byte{},
+	}
+	f.init()
+	return f
+}
+
+func (f *fakeAzurite) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>%s\nRequestId:1</Message></Error>", code, code)
+}
+
+// authorized checks the SharedKey signature with azureSignature, which
+// TestAzureSignature checks against fixed vectors, or a SAS token
+func (f *fakeAzurite) authorized(r *http.Request) bool {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return auth == "SharedKey "+azuriteAccount+":"+azureSignature(azuriteAccount, f.key, r)
+	}
+	query := r.URL.Query()
+	return query.Get("sig") == f.sas && query.Get("sv") != ""
+}
+
+func (f *fakeAzurite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		f.error(w, 400, "MissingRequiredHeader")
+		return
+	}
+	if !f.authorized(r) {
+		f.error(w, 403, "AuthenticationFailed")
+		return
+	}
+
+	// path style: /{account}/{container}/{blob}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] != azuriteAccount || parts[1] != "releases" {
+		f.error(w, 404, "ContainerNotFound")
+		return
+	}
+	blob := ""
+	if len(parts) == 3 {
+		blob = parts[2]
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	switch {
+	case r.Method == "GET" && blob == "" && query.Get("comp") == "list":
+		f.list(w, query)
+	case r.Method == "PUT" && query.Get("comp") == "block":
+		if f.blocks[blob] == nil {
+			f.blocks[blob] = map[string][]byte{}
+		}
+		f.blocks[blob][query.Get("blockid")] = body
+		w.WriteHeader(201)
+	case r.Method == "PUT" && query.Get("comp") == "blocklist":
+		var list azureBlockList
+		if err := xml.Unmarshal(body, &list); err != nil {
+			f.error(w, 400, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := f.blocks[blob][id]
+			if !ok {
+				f.error(w, 400, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		delete(f.blocks, blob)
+		f.objects[blob] = data
+		f.etags[blob] = fmt.Sprintf(`"0x%X"`, len(f.etags)+1)
+		delete(f.md5s, blob)
+		w.WriteHeader(201)
+	case r.Method == "PUT":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			f.error(w, 400, "MissingRequiredHeader")
+			return
+		}
+		sum := md5.Sum(body)
+		f.puts++
+		f.objects[blob] = body
+		f.etags[blob] = fmt.Sprintf(`"0x%X"`, len(f.etags)+1)
+		f.md5s[blob] = base64.StdEncoding.EncodeToString(sum[:])
+		w.WriteHeader(201)
+	case r.Method == "DELETE":
+		if _, ok := f.objects[blob]; !ok {
+			f.error(w, 404, "BlobNotFound")
+			return
+		}
+		delete(f.objects, blob)
+		w.WriteHeader(202)
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := f.objects[blob]
+		if !ok {
+			f.error(w, 404, "BlobNotFound")
+			return
+		}
+		w.Header().Set("ETag", f.etags[blob])
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if f.md5s[blob] != "" {
+			w.Header().Set("Content-MD5", f.md5s[blob])
+		}
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	default:
+		f.error(w, 400, "UnsupportedHttpVerb")
+	}
+}
+
+func (f *fakeAzurite) list(w http.ResponseWriter, query map[string][]string) {
+	get := func(k string) string {
+		if len(query[k]) > 0 {
+			return query[k][0]
+		}
+		return ""
+	}
+	delimiter := get("delimiter")
+	entries, next := f.page(get("prefix"), delimiter, get("marker"))
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for _, entry := range entries {
+		if delimiter != "" && strings.HasSuffix(entry, delimiter) {
+			fmt.Fprintf(&buf, "<BlobPrefix><Name>%s</Name></BlobPrefix>", entry)
+		} else {
+			fmt.Fprintf(&buf, "<Blob><Name>%s</Name><Properties></Properties></Blob>", entry)
+		}
+	}
+	fmt.Fprintf(&buf, "</Blobs><NextMarker>%s</NextMarker></EnumerationResults>", next)
+	w.Write(buf.Bytes())
+}
+
+func TestAzureProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeAzurite()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	az := &AzureProvider{client: http.DefaultClient}
+	loc := func(blob string) Location {
+		return Location{"type": "azure", "host": azuriteAccount, "path": "/releases/" + blob,
+			"key": azuriteKey, "endpoint": srv.URL + "/" + azuriteAccount}
+	}
+
+	// put and get
+	assert.Nil(az.Put(loc("v1/a b+c.txt"), strings.NewReader("hello")))
+	rc, err := az.Get(loc("v1/a b+c.txt"))
+	if assert.Nil(err) {
+		bs, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal("hello", string(bs))
+	}
+
+	// version and stat
+	version, err := az.Version(loc("v1/a b+c.txt"), "")
+	assert.Nil(err)
+	assert.Equal(fake.etags["v1/a b+c.txt"], version)
+	fi, err := az.Stat(loc("v1/a b+c.txt"))
+	assert.Nil(err)
+	assert.Equal(int64(5), fi.Size)
+	assert.Equal(fmt.Sprintf("%x", md5.Sum([]byte("hello"))), fi.Hash)
+	assert.False(fi.ModTime.IsZero())
+	assert.Nil(az.Put(loc("v1/a b+c.txt"), strings.NewReader("hello")))
+	version2, _ := az.Version(loc("v1/a b+c.txt"), version)
+	assert.NotEqual(version, version2)
+
+	// missing files and containers
+	_, err = az.Get(loc("missing"))
+	assert.True(os.IsNotExist(err), "expected not exist, got %v", err)
+	missing := loc("a.txt")
+	missing["path"] = "/other/a.txt"
+	_, err = az.Get(missing)
+	assert.False(os.IsNotExist(err))
+	assert.Contains(fmt.Sprint(err), "ContainerNotFound")
+
+	// blocks
+	defer func(size int) { azureBlockSize = size }(azureBlockSize)
+	azureBlockSize = 4
+	puts := fake.puts
+	assert.Nil(az.Put(loc("big.bin"), strings.NewReader("0123456789")))
+	assert.Equal(puts, fake.puts)
+	assert.Equal("0123456789", string(fake.objects["big.bin"]))
+	assert.Empty(fake.blocks)
+	fi, err = az.Stat(loc("big.bin"))
+	assert.Nil(err)
+	assert.Equal(int64(10), fi.Size)
+	assert.Equal("", fi.Hash)
+	assert.Nil(az.Put(loc("four.bin"), strings.NewReader("0123")))
+	assert.Equal("0123", string(fake.objects["four.bin"]))
+	azureBlockSize = 4 << 20
+
+	// list with pagination
+	for _, blob := range []string{"v1/c.txt", "v1/d/e.txt", "v2/f.txt"} {
+		assert.Nil(az.Put(loc(blob), strings.NewReader(blob)))
+	}
+	names, err := az.List(loc("v1"))
+	assert.Nil(err)
+	assert.Equal([]string{"a b+c.txt", "c.txt", "d/"}, names)
+	names, err = az.List(loc(""))
+	assert.Nil(err)
+	assert.Equal([]string{"big.bin", "four.bin", "v1/", "v2/"}, names)
+
+	// delete
+	assert.Nil(az.Delete(loc("v2/f.txt")))
+	_, err = az.Get(loc("v2/f.txt"))
+	assert.True(os.IsNotExist(err))
+
+	// shared access signatures
+	sas := loc("v1/c.txt")
+	delete(sas, "key")
+	sas["sas"] = "?sv=2020-04-08&sr=c&sp=rwdl&sig=fakesig"
+	rc, err = az.Get(sas)
+	if assert.Nil(err) {
+		bs, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal("v1/c.txt", string(bs))
+	}
+	sas["path"] = "/releases/v1"
+	names, err = az.List(sas)
+	assert.Nil(err)
+	assert.Equal([]string{"a b+c.txt", "c.txt", "d/"}, names)
+	sas["sas"] = "sv=2020-04-08&sig=wrong"
+	_, err = az.Get(sas)
+	assert.Contains(fmt.Sprint(err), "AuthenticationFailed")
+
+	// bad credentials
+	bad := loc("v1/c.txt")
+	bad["key"] = base64.StdEncoding.EncodeToString([]byte("wrong"))
+	_, err = az.Get(bad)
+	assert.Contains(fmt.Sprint(err), "AuthenticationFailed")
+}
@@ -5,12 +5,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+
+	"github.com/badgerodon/stack/logging"
 )
 
 type (
@@ -99,7 +100,7 @@ func (ccsp *CopyCloudStorageProvider) post(method string, params interface{}, he
 func (ccsp *CopyCloudStorageProvider) updateObjects(params interface{}, tok string) (map[string]interface{}, error) {
 	h := make(http.Header)
 	h.Set("X-Authorization", tok)
-	log.Println(params)
+	logging.Debug("copy request", "params", params)
 	return ccsp.post("update_objects", map[string]interface{}{
 		"meta": []interface{}{params},
 	}, h)
@@ -1,24 +1,463 @@
 package storage
 
 import (
+	"bufio"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // ftp[s]://user[:password]@other.host[:port]/some_dir
 
 type (
-	FTPProvider byte
+	FTPProvider struct {
+		// tlsConfig is used for ftps, ie to trust a test certificate
+		tlsConfig *tls.Config
+	}
+
+	ftpref struct {
+		addr, host, user, password, path string
+		tls                              bool
+		skipVerify                       bool
+	}
+
+	// ftpConn is a control connection to an ftp server
+	ftpConn struct {
+		*textproto.Conn
+		conn      net.Conn
+		ref       ftpref
+		tlsConfig *tls.Config
+	}
+
+	// ftpDataConn is a data connection, which completes the transfer when
+	// closed
+	ftpDataConn struct {
+		net.Conn
+		c *ftpConn
+		// quit closes the control connection too
+		quit bool
+	}
 )
 
-func (fp FTPProvider) Get(rawurl string) (io.ReadCloser, error) {
-	return nil, fmt.Errorf("not implemented")
+var FTP = &FTPProvider{}
+
+var ftpTimeout = 30 * time.Second
+
+func init() {
+	Register("ftp", FTP)
+	Register("ftps", FTP)
+}
+
+func (fp *FTPProvider) parse(loc Location) (ftpref, error) {
+	ref := ftpref{
+		host:     loc.Host(),
+		user:     loc.Option("user", "FTP_USER"),
+		password: loc.Option("password", "FTP_PASSWORD"),
+		tls:      loc.Type() == "ftps",
+	}
+	if ref.host == "" {
+		return ref, fmt.Errorf("ftp host is required")
+	}
+	ref.addr = ref.host
+	if h, _, err := net.SplitHostPort(ref.host); err == nil {
+		ref.host = h
+	} else {
+		ref.addr = net.JoinHostPort(ref.host, "21")
+	}
+	if ref.user == "" {
+		ref.user, ref.password = "anonymous", "anonymous@"
+	}
+	if v := loc.Option("tls_skip_verify", "FTP_TLS_SKIP_VERIFY"); v != "" {
+		var err error
+		ref.skipVerify, err = strconv.ParseBool(v)
+		if err != nil {
+			return ref, fmt.Errorf("invalid tls_skip_verify: %s", v)
+		}
+	}
+
+	// like curl, paths are relative to the login folder unless they start
+	// with a double slash
+	ref.path = strings.TrimPrefix(loc.Path(), "/")
+	if ref.path == "" {
+		ref.path = "."
+	}
+	return ref, nil
+}
+
+func (ref ftpref) String() string {
+	scheme := "ftp"
+	if ref.tls {
+		scheme = "ftps"
+	}
+	return scheme + "://" + ref.addr + "/" + ref.path
+}
+
+// dial connects and logs in to the server
+func (fp *FTPProvider) dial(loc Location) (*ftpConn, error) {
+	ref, err := fp.parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", ref.addr, ftpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{Conn: textproto.NewConn(conn), conn: conn, ref: ref}
+	if _, _, err := c.ReadResponse(2); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error connecting to %s: %v", ref.addr, err)
+	}
+
+	// explicit tls
+	if ref.tls {
+		if fp.tlsConfig != nil {
+			c.tlsConfig = fp.tlsConfig.Clone()
+		} else {
+			c.tlsConfig = &tls.Config{}
+		}
+		if c.tlsConfig.ServerName == "" {
+			c.tlsConfig.ServerName = ref.host
+		}
+		if ref.skipVerify {
+			c.tlsConfig.InsecureSkipVerify = true
+		}
+		// servers often require data connections to resume the session
+		c.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		if _, _, err := c.cmd(2, "AUTH TLS"); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error starting tls: %v", err)
+		}
+		tconn := tls.Client(conn, c.tlsConfig)
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error starting tls: %v", err)
+		}
+		c.Conn, c.conn = textproto.NewConn(tconn), tconn
+	}
+
+	code, _, err := c.cmd(0, "USER %s", ref.user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", ref.password)
+	}
+	if err == nil && code != 230 && code != 202 {
+		err = fmt.Errorf("%d login failed", code)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error logging in to %s as %s: %v", ref.addr, ref.user, err)
+	}
+
+	if ref.tls {
+		if _, _, err := c.cmd(2, "PBSZ 0"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if _, _, err := c.cmd(2, "PROT P"); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd sends a command and reads the response. An expectCode of 0 accepts
+// any code.
+func (c *ftpConn) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	c.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.ReadResponse(expectCode)
+	if err != nil {
+		return code, msg, c.error(err)
+	}
+	return code, msg, nil
+}
+
+// error converts "file unavailable" responses to not exist errors
+func (c *ftpConn) error(err error) error {
+	if tperr, ok := err.(*textproto.Error); ok && tperr.Code == 550 {
+		return &os.PathError{Op: "ftp", Path: c.ref.String(), Err: os.ErrNotExist}
+	}
+	return err
+}
+
+func (c *ftpConn) Close() error {
+	c.cmd(0, "QUIT")
+	return c.Conn.Close()
+}
+
+// data opens a passive data connection and sends the command that uses it
+func (c *ftpConn) data(format string, args ...interface{}) (*ftpDataConn, error) {
+	port, err := c.passive()
+	if err != nil {
+		return nil, err
+	}
+	// the address the server reports is often wrong behind nat, so the data
+	// connection always goes to the same host as the control connection
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), ftpTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error opening data connection: %v", err)
+	}
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if c.tlsConfig != nil {
+		tconn := tls.Client(conn, c.tlsConfig)
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error starting tls on data connection: %v", err)
+		}
+		conn = tconn
+	}
+	conn.SetDeadline(time.Time{})
+	return &ftpDataConn{Conn: conn, c: c}, nil
+}
+
+// passive enters passive mode and returns the data port
+func (c *ftpConn) passive() (int, error) {
+	// 229 Entering Extended Passive Mode (|||port|)
+	if _, msg, err := c.cmd(2, "EPSV"); err == nil {
+		fields := strings.Split(msg[strings.Index(msg, "(")+1:], "|")
+		if len(fields) >= 4 {
+			if port, err := strconv.Atoi(fields[3]); err == nil {
+				return port, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid EPSV response: %s", msg)
+	}
+
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	_, msg, err := c.cmd(2, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("invalid PASV response: %s", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("invalid PASV response: %s", msg)
+	}
+	p1, err1 := strconv.Atoi(fields[4])
+	p2, err2 := strconv.Atoi(fields[5])
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid PASV response: %s", msg)
+	}
+	return p1<<8 | p2, nil
+}
+
+// Close closes the data connection and waits for the transfer to complete
+func (dc *ftpDataConn) Close() error {
+	err := dc.Conn.Close()
+	if err == nil {
+		dc.c.conn.SetDeadline(time.Now().Add(ftpTimeout))
+		_, _, err = dc.c.ReadResponse(2)
+	}
+	if dc.quit {
+		dc.c.Close()
+	}
+	return err
+}
+
+func (fp *FTPProvider) Delete(loc Location) error {
+	c, err := fp.dial(loc)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, _, err := c.cmd(2, "DELE %s", c.ref.path); err != nil {
+		// folders are removed with RMD
+		if _, _, rerr := c.cmd(2, "RMD %s", c.ref.path); rerr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (fp *FTPProvider) Get(loc Location) (io.ReadCloser, error) {
+	c, err := fp.dial(loc)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := c.data("RETR %s", c.ref.path)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	dc.quit = true
+	return dc, nil
+}
+
+func (fp *FTPProvider) Put(loc Location, rdr io.Reader) error {
+	c, err := fp.dial(loc)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// create the parent folders, which may already exist
+	dir := path.Dir(c.ref.path)
+	var dirs []string
+	for ; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		c.cmd(0, "MKD %s", dirs[i])
+	}
+
+	dc, err := c.data("STOR %s", c.ref.path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dc, rdr); err != nil {
+		dc.Conn.Close()
+		return err
+	}
+	return dc.Close()
+}
+
+func (fp *FTPProvider) List(loc Location) ([]string, error) {
+	c, err := fp.dial(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// MLSD is machine readable, but older servers only support LIST
+	mlsd := true
+	dc, err := c.data("MLSD %s", c.ref.path)
+	if tperr, ok := err.(*textproto.Error); ok && tperr.Code >= 500 && tperr.Code < 550 {
+		mlsd = false
+		dc, err = c.data("LIST %s", c.ref.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	scanner := bufio.NewScanner(dc)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		var name string
+		var isDir bool
+		if mlsd {
+			name, isDir = ftpParseMLSD(line)
+		} else {
+			name, isDir = ftpParseLIST(line)
+		}
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+		if isDir {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	if err := scanner.Err(); err != nil {
+		dc.Conn.Close()
+		return nil, err
+	}
+	if err := dc.Close(); err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fp *FTPProvider) Version(loc Location, previous string) (string, error) {
+	fi, err := fp.Stat(loc)
+	if err != nil {
+		return "", err
+	}
+	return fi.version(), nil
+}
+
+func (fp *FTPProvider) Stat(loc Location) (FileInfo, error) {
+	c, err := fp.dial(loc)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer c.Close()
+
+	// 213 YYYYMMDDHHMMSS[.sss]
+	_, msg, err := c.cmd(2, "MDTM %s", c.ref.path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi := FileInfo{}
+	fi.ModTime, err = time.Parse("20060102150405", strings.SplitN(strings.TrimSpace(msg), ".", 2)[0])
+	if err != nil {
+		return fi, fmt.Errorf("invalid MDTM response: %s", msg)
+	}
+	_, msg, err = c.cmd(2, "SIZE %s", c.ref.path)
+	if err != nil {
+		return fi, err
+	}
+	fi.Size, err = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil {
+		return fi, fmt.Errorf("invalid SIZE response: %s", msg)
+	}
+	return fi, nil
 }
 
-func (fp FTPProvider) Put(rawurl string, rdr io.Reader) error {
-	return fmt.Errorf("not implemented")
+// ftpParseMLSD parses a line like "type=file;size=5;modify=20060102150405; name"
+func ftpParseMLSD(line string) (name string, isDir bool) {
+	i := strings.Index(line, " ")
+	if i < 0 {
+		return "", false
+	}
+	for _, fact := range strings.Split(line[:i], ";") {
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) == 2 && strings.ToLower(kv[0]) == "type" {
+			switch strings.ToLower(kv[1]) {
+			case "dir":
+				isDir = true
+			case "cdir", "pdir":
+				return "", false
+			}
+		}
+	}
+	return line[i+1:], isDir
 }
 
-func (fp FTPProvider) List(rawurl string) ([]string, error) {
-	return nil, fmt.Errorf("not implemented")
+// ftpParseLIST parses a line of unix ls output like
+// "drwxr-xr-x 2 user group 4096 Jan 1 12:00 name"
+func ftpParseLIST(line string) (name string, isDir bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 9 || strings.HasPrefix(line, "total") {
+		return "", false
+	}
+	// names may contain spaces, so find the ninth field in the line
+	rest := line
+	for i := 0; i < 8; i++ {
+		rest = strings.TrimLeft(rest, " ")
+		rest = rest[strings.Index(rest, " "):]
+	}
+	name = strings.TrimLeft(rest, " ")
+	switch line[0] {
+	case 'd':
+		isDir = true
+	case 'l':
+		if i := strings.Index(name, " -> "); i >= 0 {
+			name = name[:i]
+		}
+	}
+	return name, isDir
 }
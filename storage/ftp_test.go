@@ -0,0 +1,443 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFTP is an in-memory ftp server
+type fakeFTP struct {
+	mu         sync.Mutex
+	ln         net.Listener
+	user       string
+	password   string
+	tlsConfig  *tls.Config
+	noEPSV     bool
+	noMLSD     bool
+	files      map[string][]byte
+	mtimes     map[string]time.Time
+	dirs       map[string]bool
+	insecure   int
+	passiveTLS int
+}
+
+func newFakeFTP(t *testing.T) *fakeFTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeFTP{
+		ln:       ln,
+		user:     "user",
+		password: "secret",
+		files:    map[string][]byte{},
+		mtimes:   map[string]time.Time{},
+		dirs:     map[string]bool{".": true},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeFTP) Close() error {
+	return f.ln.Close()
+}
+
+func (f *fakeFTP) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	rdr := bufio.NewReader(conn)
+	reply := func(code int, format string, args ...interface{}) {
+		fmt.Fprintf(conn, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+	}
+	reply(220, "fake ftp ready")
+
+	var user string
+	var loggedIn, prot, secure bool
+	var pasv net.Listener
+	// accept waits for the passive data connection
+	accept := func() (net.Conn, bool) {
+		if pasv == nil {
+			reply(425, "use PASV first")
+			return nil, false
+		}
+		defer func() { pasv.Close(); pasv = nil }()
+		reply(150, "opening data connection")
+		dc, err := pasv.Accept()
+		if err != nil {
+			return nil, false
+		}
+		if prot {
+			tc := tls.Server(dc, f.tlsConfig)
+			if tc.Handshake() != nil {
+				dc.Close()
+				return nil, false
+			}
+			f.mu.Lock()
+			f.passiveTLS++
+			f.mu.Unlock()
+			return tc, true
+		}
+		return dc, true
+	}
+	listen := func() bool {
+		var err error
+		pasv, err = net.Listen("tcp", "127.0.0.1:0")
+		return err == nil
+	}
+
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		cmd = strings.ToUpper(cmd)
+		p := path.Clean(arg)
+
+		if !loggedIn && cmd != "USER" && cmd != "PASS" && cmd != "AUTH" && cmd != "QUIT" {
+			reply(530, "not logged in")
+			continue
+		}
+
+		f.mu.Lock()
+		switch cmd {
+		case "AUTH":
+			if f.tlsConfig == nil {
+				reply(502, "tls not supported")
+				break
+			}
+			reply(234, "starting tls")
+			tc := tls.Server(conn, f.tlsConfig)
+			if tc.Handshake() != nil {
+				f.mu.Unlock()
+				return
+			}
+			conn, rdr, secure = tc, bufio.NewReader(tc), true
+		case "USER":
+			user = arg
+			reply(331, "password required")
+		case "PASS":
+			if user == f.user && arg == f.password {
+				loggedIn = true
+				if !secure {
+					f.insecure++
+				}
+				reply(230, "logged in")
+			} else {
+				reply(530, "login incorrect")
+			}
+		case "PBSZ", "TYPE":
+			reply(200, "ok")
+		case "PROT":
+			prot = arg == "P"
+			reply(200, "ok")
+		case "EPSV":
+			if f.noEPSV {
+				reply(502, "not implemented")
+			} else if listen() {
+				reply(229, "Entering Extended Passive Mode (|||%d|)", pasv.Addr().(*net.TCPAddr).Port)
+			}
+		case "PASV":
+			if listen() {
+				port := pasv.Addr().(*net.TCPAddr).Port
+				// a private address, as if behind nat
+				reply(227, "Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "RETR":
+			data, ok := f.files[p]
+			if !ok {
+				reply(550, "no such file")
+				break
+			}
+			f.mu.Unlock()
+			if dc, ok := accept(); ok {
+				dc.Write(data)
+				dc.Close()
+				reply(226, "transfer complete")
+			}
+			continue
+		case "STOR":
+			if !f.dirs[path.Dir(p)] {
+				reply(550, "no such folder")
+				break
+			}
+			f.mu.Unlock()
+			if dc, ok := accept(); ok {
+				data, _ := ioutil.ReadAll(dc)
+				dc.Close()
+				f.mu.Lock()
+				f.files[p] = data
+				f.mtimes[p] = time.Now().UTC().Truncate(time.Second)
+				f.mu.Unlock()
+				reply(226, "transfer complete")
+			}
+			continue
+		case "MKD":
+			if f.dirs[p] || !f.dirs[path.Dir(p)] {
+				reply(550, "can't create folder")
+			} else {
+				f.dirs[p] = true
+				reply(257, "%q created", p)
+			}
+		case "MLSD", "LIST":
+			if cmd == "MLSD" && f.noMLSD {
+				reply(500, "unknown command")
+				break
+			}
+			if !f.dirs[p] {
+				reply(550, "no such folder")
+				break
+			}
+			var lines []string
+			for name, data := range f.files {
+				if path.Dir(name) == p {
+					if cmd == "MLSD" {
+						lines = append(lines, fmt.Sprintf("type=file;size=%d;modify=%s; %s", len(data), f.mtimes[name].Format("20060102150405"), path.Base(name)))
+					} else {
+						lines = append(lines, fmt.Sprintf("-rw-r--r--    1 ftp      ftp      %8d Jan 01 12:00 %s", len(data), path.Base(name)))
+					}
+				}
+			}
+			for name := range f.dirs {
+				if name != "." && path.Dir(name) == p {
+					if cmd == "MLSD" {
+						lines = append(lines, "type=dir;modify=20200101000000; "+path.Base(name))
+					} else {
+						lines = append(lines, "drwxr-xr-x    2 ftp      ftp          4096 Jan 01 12:00 "+path.Base(name))
+					}
+				}
+			}
+			if cmd == "MLSD" {
+				lines = append(lines, "type=cdir; "+p, "type=pdir; ..")
+			} else {
+				lines = append(lines, "total 8")
+			}
+			sort.Strings(lines)
+			f.mu.Unlock()
+			if dc, ok := accept(); ok {
+				for _, l := range lines {
+					fmt.Fprintf(dc, "%s\r\n", l)
+				}
+				dc.Close()
+				reply(226, "transfer complete")
+			}
+			continue
+		case "DELE":
+			if _, ok := f.files[p]; ok {
+				delete(f.files, p)
+				reply(250, "deleted")
+			} else {
+				reply(550, "no such file")
+			}
+		case "RMD":
+			empty := f.dirs[p] && p != "."
+			for name := range f.files {
+				if strings.HasPrefix(name, p+"/") {
+					empty = false
+				}
+			}
+			if empty {
+				delete(f.dirs, p)
+				reply(250, "removed")
+			} else {
+				reply(550, "can't remove folder")
+			}
+		case "MDTM":
+			if mtime, ok := f.mtimes[p]; ok && f.files[p] != nil {
+				reply(213, "%s", mtime.Format("20060102150405"))
+			} else {
+				reply(550, "no such file")
+			}
+		case "SIZE":
+			if data, ok := f.files[p]; ok {
+				reply(213, "%d", len(data))
+			} else {
+				reply(550, "no such file")
+			}
+		case "QUIT":
+			reply(221, "bye")
+			f.mu.Unlock()
+			return
+		default:
+			reply(502, "not implemented")
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestFTPParse(t *testing.T) {
+	defer os.Setenv("FTP_USER", os.Getenv("FTP_USER"))
+	defer os.Setenv("FTP_PASSWORD", os.Getenv("FTP_PASSWORD"))
+	os.Unsetenv("FTP_USER")
+	os.Unsetenv("FTP_PASSWORD")
+
+	var fp FTPProvider
+	loc, _ := ParseLocation("ftps://bob:pw@ftp.example.com/builds/app.tgz")
+	ref, err := fp.parse(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, ftpref{addr: "ftp.example.com:21", host: "ftp.example.com", user: "bob", password: "pw", path: "builds/app.tgz", tls: true}, ref)
+
+	loc, _ = ParseLocation("ftp://ftp.example.com:2121//pub/app.tgz")
+	ref, err = fp.parse(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, ftpref{addr: "ftp.example.com:2121", host: "ftp.example.com", user: "anonymous", password: "anonymous@", path: "/pub/app.tgz"}, ref)
+
+	os.Setenv("FTP_USER", "alice")
+	os.Setenv("FTP_PASSWORD", "secret")
+	loc, _ = ParseLocation("ftp://ftp.example.com")
+	ref, err = fp.parse(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", ref.user)
+	assert.Equal(t, "secret", ref.password)
+	assert.Equal(t, ".", ref.path)
+
+	_, err = fp.parse(Location{"type": "ftp", "path": "/a"})
+	assert.NotNil(t, err)
+}
+
+func TestFTPListParse(t *testing.T) {
+	name, isDir := ftpParseMLSD("type=file;size=5;modify=20200101000000; a file.txt")
+	assert.Equal(t, "a file.txt", name)
+	assert.False(t, isDir)
+	name, isDir = ftpParseMLSD("Type=dir;Modify=20200101000000; releases")
+	assert.Equal(t, "releases", name)
+	assert.True(t, isDir)
+	name, _ = ftpParseMLSD("type=cdir; /home/user")
+	assert.Equal(t, "", name)
+
+	name, isDir = ftpParseLIST("-rw-r--r--    1 ftp  ftp  1234 Jan 01 12:00 a  file.txt")
+	assert.Equal(t, "a  file.txt", name)
+	assert.False(t, isDir)
+	name, isDir = ftpParseLIST("drwxr-xr-x 2 ftp ftp 4096 Jan 01  2020 releases")
+	assert.Equal(t, "releases", name)
+	assert.True(t, isDir)
+	name, _ = ftpParseLIST("lrwxrwxrwx 1 ftp ftp 7 Jan 01 12:00 latest -> v1.tgz")
+	assert.Equal(t, "latest", name)
+	name, _ = ftpParseLIST("total 8")
+	assert.Equal(t, "", name)
+}
+
+func testFTPProvider(t *testing.T, fp *FTPProvider, f *fakeFTP, scheme string) {
+	assert := assert.New(t)
+	loc := func(p string, query ...string) Location {
+		l, _ := ParseLocation(scheme + "://user:secret@" + f.ln.Addr().String() + "/" + p + strings.Join(query, ""))
+		return l
+	}
+
+	// put creates the folders
+	assert.Nil(fp.Put(loc("releases/v1/app.tgz"), strings.NewReader("hello")))
+	assert.Equal("hello", string(f.files["releases/v1/app.tgz"]))
+	rc, err := fp.Get(loc("releases/v1/app.tgz"))
+	if assert.Nil(err) {
+		bs, _ := ioutil.ReadAll(rc)
+		assert.Nil(rc.Close())
+		assert.Equal("hello", string(bs))
+	}
+
+	// version and stat
+	version, err := fp.Version(loc("releases/v1/app.tgz"), "")
+	assert.Nil(err)
+	assert.Equal(f.mtimes["releases/v1/app.tgz"].Format("20060102150405")+"-5", version)
+	fi, err := fp.Stat(loc("releases/v1/app.tgz"))
+	assert.Nil(err)
+	assert.Equal(int64(5), fi.Size)
+	assert.Equal(f.mtimes["releases/v1/app.tgz"], fi.ModTime)
+
+	// missing files
+	_, err = fp.Get(loc("missing.tgz"))
+	assert.True(os.IsNotExist(err), "expected not exist, got %v", err)
+	_, err = fp.Version(loc("missing.tgz"), "")
+	assert.True(os.IsNotExist(err), "expected not exist, got %v", err)
+
+	// list
+	assert.Nil(fp.Put(loc("releases/v1 notes.txt"), strings.NewReader("notes")))
+	names, err := fp.List(loc("releases"))
+	assert.Nil(err)
+	assert.Equal([]string{"v1 notes.txt", "v1/"}, names)
+	names, err = fp.List(loc(""))
+	assert.Nil(err)
+	assert.Equal([]string{"releases/"}, names)
+	_, err = fp.List(loc("missing"))
+	assert.True(os.IsNotExist(err), "expected not exist, got %v", err)
+
+	// delete files and empty folders
+	assert.Nil(fp.Delete(loc("releases/v1/app.tgz")))
+	assert.Nil(fp.Delete(loc("releases/v1")))
+	names, err = fp.List(loc("releases"))
+	assert.Nil(err)
+	assert.Equal([]string{"v1 notes.txt"}, names)
+	assert.True(os.IsNotExist(fp.Delete(loc("missing.tgz"))))
+
+	// bad credentials
+	bad := loc("releases/v1 notes.txt")
+	bad["password"] = "wrong"
+	_, err = fp.Get(bad)
+	assert.Contains(fmt.Sprint(err), "530")
+}
+
+func TestFTPProvider(t *testing.T) {
+	f := newFakeFTP(t)
+	defer f.Close()
+	testFTPProvider(t, &FTPProvider{}, f, "ftp")
+
+	// older servers without EPSV or MLSD
+	f = newFakeFTP(t)
+	defer f.Close()
+	f.noEPSV, f.noMLSD = true, true
+	testFTPProvider(t, &FTPProvider{}, f, "ftp")
+}
+
+func TestFTPS(t *testing.T) {
+	assert := assert.New(t)
+
+	// borrow the test certificate, which is valid for 127.0.0.1
+	hs := httptest.NewTLSServer(http.NotFoundHandler())
+	defer hs.Close()
+	trusted := &tls.Config{RootCAs: hs.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	f := newFakeFTP(t)
+	defer f.Close()
+	f.tlsConfig = hs.TLS
+	testFTPProvider(t, &FTPProvider{tlsConfig: trusted}, f, "ftps")
+	assert.Equal(0, f.insecure)
+	assert.NotZero(f.passiveTLS)
+
+	// an untrusted certificate
+	addr := f.ln.Addr().String()
+	err := (&FTPProvider{}).Put(Location{"type": "ftps", "host": addr, "path": "/a.txt", "user": "user", "password": "secret"}, strings.NewReader("a"))
+	assert.Contains(fmt.Sprint(err), "certificate")
+	loc, _ := ParseLocation("ftps://user:secret@" + addr + "/a.txt?tls_skip_verify=true")
+	assert.Nil((&FTPProvider{}).Put(loc, strings.NewReader("a")))
+
+	// servers without tls are refused
+	plain := newFakeFTP(t)
+	defer plain.Close()
+	err = (&FTPProvider{tlsConfig: trusted}).Put(Location{"type": "ftps", "host": plain.ln.Addr().String(), "path": "/a.txt", "user": "user", "password": "secret"}, strings.NewReader("a"))
+	assert.Contains(fmt.Sprint(err), "error starting tls")
+	assert.Equal(0, plain.insecure)
+}
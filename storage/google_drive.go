@@ -235,7 +235,7 @@ func (gdp GoogleDriveProvider) Authenticate() {
 	}
 
 	bs, _ := json.MarshalIndent(token, "", "  ")
-	log.Println(string(bs))
+	fmt.Println(string(bs))
 }
 
 func (gdp GoogleDriveProvider) Delete(loc Location) error {
@@ -294,7 +294,11 @@ func (gdp GoogleDriveProvider) List(loc Location) ([]string, error) {
 	}
 	names := []string{}
 	for _, item := range fileList {
-		names = append(names, item.Title)
+		if item.MimeType == "application/vnd.google-apps.folder" {
+			names = append(names, item.Title+"/")
+		} else {
+			names = append(names, item.Title)
+		}
 	}
 	return names, nil
 }
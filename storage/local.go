@@ -32,6 +32,11 @@ func (lp LocalProvider) Get(location Location) (io.ReadCloser, error) {
 }
 
 func (lp LocalProvider) Put(location Location, rdr io.Reader) error {
+	// like object stores, create missing folders
+	err := os.MkdirAll(filepath.Dir(location.Path()), 0755)
+	if err != nil {
+		return err
+	}
 	f, err := os.Create(location.Path())
 	if err != nil {
 		return err
@@ -52,21 +57,31 @@ func (lp LocalProvider) List(loc Location) ([]string, error) {
 	}
 	files := []string{}
 	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
 		if p == root {
+			// a missing folder isn't the same as an empty one
+			return err
+		}
+		if err != nil {
 			return nil
 		}
-		files = append(files, p)
 		if fi.IsDir() {
+			files = append(files, p+"/")
 			return filepath.SkipDir
 		}
+		files = append(files, p)
 		return nil
 	})
 	return files, err
 }
 
+func (lp LocalProvider) Stat(loc Location) (FileInfo, error) {
+	fi, err := os.Stat(loc.Path())
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
 func (lp LocalProvider) Version(loc Location, previous string) (string, error) {
 	fi, err := os.Stat(loc.Path())
 	if err != nil {
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// LocalDebounce is how long to wait for more changes after a file changes
+// before reporting it. Editors often write a file in several steps.
+var LocalDebounce = time.Millisecond * 100
+
+// Watch reports changes to a local file using inotify. The file's directory
+// is watched so that files replaced by a rename are still picked up.
+func (lp LocalProvider) Watch(loc Location, done <-chan struct{}) (<-chan struct{}, error) {
+	path, err := filepath.Abs(loc.Path())
+	if err != nil {
+		return nil, err
+	}
+	dir, name := filepath.Split(path)
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("error creating inotify instance: %v", err)
+	}
+	_, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|
+		syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_MODIFY|syscall.IN_ATTRIB)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("error watching %s: %v", dir, err)
+	}
+	// the file is closed when done, which unblocks the read below
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	events := make(chan struct{}, 1)
+	go func() {
+		<-done
+		f.Close()
+	}()
+	go func() {
+		buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*16)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			if containsName(buf[:n], name) {
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	change := make(chan struct{})
+	go debounce(events, change, done, LocalDebounce)
+	return change, nil
+}
+
+// containsName returns true if any of the inotify events are for name
+func containsName(buf []byte, name string) bool {
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		evt := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		end := syscall.SizeofInotifyEvent + int(evt.Len)
+		if end > len(buf) {
+			break
+		}
+		n := buf[syscall.SizeofInotifyEvent:end]
+		for len(n) > 0 && n[len(n)-1] == 0 {
+			n = n[:len(n)-1]
+		}
+		if string(n) == name {
+			return true
+		}
+		buf = buf[end:]
+	}
+	return false
+}
+
+// debounce forwards events to change once no more have arrived for delay
+func debounce(events <-chan struct{}, change chan<- struct{}, done <-chan struct{}, delay time.Duration) {
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-events:
+			timer = time.After(delay)
+		case <-timer:
+			timer = nil
+			select {
+			case change <- struct{}{}:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
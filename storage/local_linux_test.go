@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stack-local-watch")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stack.yaml")
+	ioutil.WriteFile(path, []byte("a"), 0644)
+
+	done := make(chan struct{})
+	defer close(done)
+	change, err := Local.Watch(Location{"type": "local", "path": path}, done)
+	if !assert.Nil(err) {
+		return
+	}
+
+	// other files are ignored
+	ioutil.WriteFile(filepath.Join(dir, "other.yaml"), []byte("b"), 0644)
+	select {
+	case <-change:
+		t.Error("expected no change for another file")
+	case <-time.After(LocalDebounce * 3):
+	}
+
+	// several writes are reported once
+	ioutil.WriteFile(path, []byte("b"), 0644)
+	ioutil.WriteFile(path, []byte("c"), 0644)
+	select {
+	case <-change:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected a change")
+	}
+	select {
+	case <-change:
+		t.Error("expected changes to be debounced")
+	case <-time.After(LocalDebounce * 3):
+	}
+
+	// replacing the file by renaming is a change
+	tmp := filepath.Join(dir, "stack.yaml.tmp")
+	ioutil.WriteFile(tmp, []byte("d"), 0644)
+	time.Sleep(LocalDebounce * 3)
+	os.Rename(tmp, path)
+	select {
+	case <-change:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected a change after rename")
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"fmt"
 	"net/url"
+	"os"
 	"path"
 	"strings"
 )
@@ -37,10 +38,54 @@ func (loc Location) Query() url.Values {
 	return vs
 }
 
+// Option returns a setting from the location, its query string or the
+// first environment variable that's set
+func (loc Location) Option(key string, envs ...string) string {
+	if v := loc[key]; v != "" {
+		return v
+	}
+	if v := loc.Query().Get(key); v != "" {
+		return v
+	}
+	for _, env := range envs {
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Join returns a copy of the location with elements added to the path
+func (loc Location) Join(elem ...string) Location {
+	joined := Location{}
+	for k, v := range loc {
+		joined[k] = v
+	}
+	joined["path"] = path.Join(append([]string{loc.Path()}, elem...)...)
+	return joined
+}
+
 func (loc Location) Type() string {
 	return loc["type"]
 }
 
+// String returns the location as a URL, without the password
+func (loc Location) String() string {
+	if loc.Type() == "local" {
+		return loc.Path()
+	}
+	u := url.URL{
+		Scheme:   loc.Type(),
+		Host:     loc.Host(),
+		Path:     loc.Path(),
+		RawQuery: loc["query"],
+	}
+	if loc["user"] != "" {
+		u.User = url.User(loc["user"])
+	}
+	return u.String()
+}
+
 func (loc *Location) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var obj interface{}
 	err := unmarshal(&obj)
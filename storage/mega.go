@@ -293,7 +293,11 @@ func (mp *MegaProvider) List(loc Location) ([]string, error) {
 	}
 	names := []string{}
 	for _, child := range children {
-		names = append(names, child.GetName())
+		if child.GetType() == mega.FOLDER {
+			names = append(names, child.GetName()+"/")
+		} else {
+			names = append(names, child.GetName())
+		}
 	}
 	sort.Strings(names)
 	return names, nil
@@ -1,104 +1,754 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
+	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/goamz/goamz/aws"
-	"github.com/goamz/goamz/s3"
+	"github.com/vaughan0/go-ini"
 )
 
+// s3://{bucket}/{key}
+// s3://s3.{region}.amazonaws.com/{bucket}/{key}
+// s3://{bucket}/{key}?endpoint=http://minio:9000
+
 type (
 	S3Provider struct {
+		client *http.Client
+
+		mu       sync.Mutex
+		instance s3Credentials
+		// clients with custom TLS settings
+		clients map[s3TLS]*http.Client
+	}
+
+	s3TLS struct {
+		skipVerify bool
+		caFile     string
 	}
 
 	s3ref struct {
-		auth   aws.Auth
-		region aws.Region
-		bucket string
-		path   string
+		bucket, key string
+		region      string
+		// regionSet is true if the region was configured, otherwise it's
+		// corrected when S3 reports a different one
+		regionSet bool
+
+		accessKey, secretKey, sessionToken string
+		profile                            string
+
+		// server is set for S3 compatible servers
+		server    *url.URL
+		pathStyle bool
+		tls       s3TLS
+	}
+
+	s3Credentials struct {
+		accessKey, secretKey, sessionToken string
+		expires                            time.Time
+	}
+
+	// s3Error is an error response from S3
+	s3Error struct {
+		StatusCode int    `xml:"-"`
+		Code       string `xml:"Code"`
+		Message    string `xml:"Message"`
+		Region     string `xml:"Region"`
+	}
+
+	s3ListResult struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+		CommonPrefixes []struct {
+			Prefix string `xml:"Prefix"`
+		} `xml:"CommonPrefixes"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+
+	s3InitiateMultipartUploadResult struct {
+		UploadID string `xml:"UploadId"`
+	}
+
+	s3CompleteMultipartUpload struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}
+
+	s3Part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
 	}
 )
 
-var S3 = &S3Provider{}
+var S3 = &S3Provider{client: http.DefaultClient, clients: map[s3TLS]*http.Client{}}
+
+var (
+	// files larger than this are uploaded in parts
+	s3PartSize = 8 << 20
+	// s3MetadataEndpoint is the EC2 instance metadata service
+	s3MetadataEndpoint = "http://169.254.169.254"
+
+	s3EndpointHostRE = regexp.MustCompile(`^s3[.-]([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+)
+
+const s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
 
 func init() {
-	//Register("s3", S3)
+	Register("s3", S3)
+}
+
+func (err s3Error) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("s3 error: %d %s", err.StatusCode, http.StatusText(err.StatusCode))
+	}
+	return fmt.Sprintf("s3 error: %s: %s", err.Code, err.Message)
 }
 
-func (s3p *S3Provider) parse(rawurl string) s3ref {
-	ref := s3ref{path: rawurl, region: aws.USEast}
-	u, err := url.Parse(rawurl)
-	if err == nil {
-		for _, region := range aws.Regions {
-			if strings.HasPrefix(region.S3Endpoint, "https://"+u.Host) {
-				ref.region = region
+func (s3p *S3Provider) parse(loc Location) (s3ref, error) {
+	ref := s3ref{
+		bucket: loc["bucket"],
+		key:    strings.TrimPrefix(loc.Path(), "/"),
+	}
+	host := strings.ToLower(loc.Host())
+	if ref.bucket == "" {
+		if m := s3EndpointHostRE.FindStringSubmatch(host); m != nil || host == "s3.amazonaws.com" {
+			// path style: the bucket is the first part of the path
+			if m != nil && m[1] != "external-1" {
+				ref.region = m[1]
+			}
+			if i := strings.Index(ref.key, "/"); i >= 0 {
+				ref.bucket, ref.key = ref.key[:i], ref.key[i+1:]
+			} else {
+				ref.bucket, ref.key = ref.key, ""
 			}
+		} else {
+			ref.bucket = loc.Host()
+		}
+	}
+
+	// region
+	if r := loc.Option("region", "AWS_REGION", "AWS_DEFAULT_REGION"); r != "" {
+		ref.region = r
+	}
+	ref.regionSet = ref.region != ""
+	if ref.region == "" {
+		ref.region = "us-east-1"
+	}
+
+	// S3 compatible servers
+	var err error
+	useTLS := true
+	if v := loc.Option("tls", "S3_TLS"); v != "" {
+		useTLS, err = strconv.ParseBool(v)
+		if err != nil {
+			return ref, fmt.Errorf("invalid s3 tls setting %s", v)
+		}
+	}
+	if v := loc.Option("tls_skip_verify", "S3_TLS_SKIP_VERIFY"); v != "" {
+		ref.tls.skipVerify, err = strconv.ParseBool(v)
+		if err != nil {
+			return ref, fmt.Errorf("invalid s3 tls_skip_verify setting %s", v)
+		}
+	}
+	ref.tls.caFile = loc.Option("ca_file", "S3_CA_FILE")
+	if endpoint := loc.Option("endpoint", "S3_ENDPOINT", "AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		ref.server, err = url.Parse(endpoint)
+		if err != nil || ref.server.Host == "" {
+			return ref, fmt.Errorf("invalid s3 endpoint %s", endpoint)
+		}
+		if !useTLS {
+			ref.server.Scheme = "http"
+		}
+		// most S3 compatible servers don't have a wildcard DNS entry for
+		// buckets
+		ref.pathStyle = true
+	}
+	if v := loc.Option("path_style", "S3_FORCE_PATH_STYLE", "AWS_S3_FORCE_PATH_STYLE"); v != "" {
+		ref.pathStyle, err = strconv.ParseBool(v)
+		if err != nil {
+			return ref, fmt.Errorf("invalid s3 path_style setting %s", v)
+		}
+	}
+	if ref.server == nil && !useTLS {
+		ref.server = &url.URL{Scheme: "http"}
+	}
+
+	// credentials
+	ref.accessKey = loc["access_key_id"]
+	if ref.accessKey == "" {
+		ref.accessKey = loc["user"]
+	}
+	ref.secretKey = loc["secret_access_key"]
+	if ref.secretKey == "" {
+		ref.secretKey = loc["password"]
+	}
+	ref.sessionToken = loc["session_token"]
+	ref.profile = loc.Option("profile")
+	return ref, nil
+}
+
+func (ref s3ref) String() string {
+	return "s3://" + ref.bucket + "/" + ref.key
+}
+
+// endpoint returns the url of a key in the bucket
+func (ref s3ref) endpoint(key string) *url.URL {
+	u := &url.URL{Scheme: "https"}
+	base := ""
+	if ref.server != nil && ref.server.Host != "" {
+		u.Scheme = ref.server.Scheme
+		u.Host = ref.server.Host
+		base = strings.TrimSuffix(ref.server.Path, "/")
+	} else {
+		if ref.server != nil {
+			u.Scheme = ref.server.Scheme
 		}
+		domain := "amazonaws.com"
+		if strings.HasPrefix(ref.region, "cn-") {
+			domain = "amazonaws.com.cn"
+		}
+		u.Host = "s3." + ref.region + "." + domain
+	}
+
+	// buckets with dots don't match the wildcard certificate, so they use
+	// path style addressing
+	if ref.pathStyle || (ref.server == nil && strings.Contains(ref.bucket, ".")) {
+		u.Path = base + "/" + ref.bucket + "/" + key
 	} else {
+		u.Host = ref.bucket + "." + u.Host
+		u.Path = base + "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	return u
+}
+
+// httpClient returns a client for the location's TLS settings
+func (s3p *S3Provider) httpClient(ref s3ref) (*http.Client, error) {
+	if ref.tls == (s3TLS{}) {
+		return s3p.client, nil
+	}
+
+	s3p.mu.Lock()
+	defer s3p.mu.Unlock()
+	if client, ok := s3p.clients[ref.tls]; ok {
+		return client, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: ref.tls.skipVerify}
+	if ref.tls.caFile != "" {
+		pem, err := ioutil.ReadFile(ref.tls.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading s3 ca file: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in s3 ca file %s", ref.tls.caFile)
+		}
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: cfg,
+	}
+	if t, ok := s3p.client.Transport.(*http.Transport); ok {
+		transport = t.Clone()
+		transport.TLSClientConfig = cfg
+	}
+	client := &http.Client{Transport: transport}
+	if s3p.clients == nil {
+		s3p.clients = map[s3TLS]*http.Client{}
+	}
+	s3p.clients[ref.tls] = client
+	return client, nil
+}
+
+// credentials finds credentials in the location, the environment, the
+// shared credentials file or the instance metadata, in that order
+func (s3p *S3Provider) credentials(ref s3ref) (s3Credentials, error) {
+	if ref.accessKey != "" && ref.secretKey != "" {
+		return s3Credentials{accessKey: ref.accessKey, secretKey: ref.secretKey, sessionToken: ref.sessionToken}, nil
+	}
+
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" {
+		return s3Credentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	profile := ref.profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = filepath.Join(os.Getenv("HOME"), ".aws", "credentials")
+	}
+	if file, err := ini.LoadFile(credentialsFile); err == nil {
+		if section, ok := file[profile]; ok && section["aws_access_key_id"] != "" {
+			return s3Credentials{
+				accessKey:    section["aws_access_key_id"],
+				secretKey:    section["aws_secret_access_key"],
+				sessionToken: section["aws_session_token"],
+			}, nil
+		}
+	}
+	if ref.profile != "" {
+		return s3Credentials{}, fmt.Errorf("aws profile %s not found in %s", ref.profile, credentialsFile)
+	}
+
+	return s3p.instanceCredentials()
+}
+
+// instanceCredentials gets the credentials of the EC2 instance role, which
+// are cached until shortly before they expire
+func (s3p *S3Provider) instanceCredentials() (s3Credentials, error) {
+	s3p.mu.Lock()
+	defer s3p.mu.Unlock()
+	if s3p.instance.accessKey != "" && time.Until(s3p.instance.expires) > time.Minute*5 {
+		return s3p.instance, nil
+	}
+
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = s3MetadataEndpoint
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	client := &http.Client{Timeout: time.Second * 2}
+
+	// IMDSv2 needs a session token, IMDSv1 is used if it isn't available
+	token := ""
+	req, _ := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	if res, err := client.Do(req); err == nil {
+		bs, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode == 200 {
+			token = string(bs)
+		}
+	}
+	get := func(p string) ([]byte, error) {
+		req, _ := http.NewRequest("GET", endpoint+"/latest/meta-data/iam/security-credentials/"+p, nil)
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return nil, fmt.Errorf("bad status from instance metadata: %s", res.Status)
+		}
+		return ioutil.ReadAll(res.Body)
+	}
+
+	bs, err := get("")
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("no aws credentials found: %v", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(bs), "\n", 2)[0])
+	bs, err = get(role)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("error getting instance credentials: %v", err)
+	}
+	var res struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	err = json.Unmarshal(bs, &res)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("invalid instance credentials: %v", err)
+	}
+	s3p.instance = s3Credentials{
+		accessKey:    res.AccessKeyID,
+		secretKey:    res.SecretAccessKey,
+		sessionToken: res.Token,
+		expires:      res.Expiration,
+	}
+	return s3p.instance, nil
+}
 
+// do sends a signed request. A request to the wrong region is retried in the
+// region S3 reports, unless a region was configured.
+func (s3p *S3Provider) do(ref s3ref, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	creds, err := s3p.credentials(ref)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3p.httpClient(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		u := ref.endpoint(key)
+		u.RawQuery = s3Query(query)
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+		req.ContentLength = int64(len(body))
+		if body == nil {
+			req.Body = nil
+		}
+		payloadHash := s3EmptyHash
+		if len(body) > 0 {
+			h := sha256.Sum256(body)
+			payloadHash = hex.EncodeToString(h[:])
+		}
+		creds.sign(req, ref.region, payloadHash, time.Now())
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode/100 == 2 {
+			return res, nil
+		}
+
+		s3err := s3Error{StatusCode: res.StatusCode}
+		bs, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		xml.Unmarshal(bs, &s3err)
+
+		region := res.Header.Get("X-Amz-Bucket-Region")
+		if region == "" {
+			region = s3err.Region
+		}
+		if attempt == 0 && !ref.regionSet && region != "" && region != ref.region {
+			ref.region = region
+			continue
+		}
+		if res.StatusCode == 404 && s3err.Code != "NoSuchBucket" {
+			return nil, &os.PathError{Op: strings.ToLower(method), Path: ref.String(), Err: os.ErrNotExist}
+		}
+		return nil, s3err
 	}
-	fmt.Println(ref)
-	return ref
 }
 
-func (s3p *S3Provider) Delete(rawurl string) error {
-	ref := s3p.parse(rawurl)
-	return s3.New(ref.auth, ref.region).Bucket(ref.bucket).Del(ref.path)
+func (s3p *S3Provider) Delete(loc Location) error {
+	ref, err := s3p.parse(loc)
+	if err != nil {
+		return err
+	}
+	res, err := s3p.do(ref, "DELETE", ref.key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
 }
 
-func (s3p *S3Provider) Get(rawurl string) (io.ReadCloser, error) {
-	ref := s3p.parse(rawurl)
-	return s3.New(ref.auth, ref.region).Bucket(ref.bucket).GetReader(ref.path)
+func (s3p *S3Provider) Get(loc Location) (io.ReadCloser, error) {
+	ref, err := s3p.parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s3p.do(ref, "GET", ref.key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
 }
 
-func (s3p *S3Provider) Put(rawurl string, rdr io.Reader) error {
-	ref := s3p.parse(rawurl)
-	contentType := mime.TypeByExtension(filepath.Ext(ref.path))
-	bucket := s3.New(ref.auth, ref.region).Bucket(ref.bucket)
+func (s3p *S3Provider) Put(loc Location, rdr io.Reader) error {
+	ref, err := s3p.parse(loc)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if contentType := mime.TypeByExtension(path.Ext(ref.key)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
 
-	if sz, err := getSize(rdr); err == nil {
-		return bucket.PutReader(ref.path, rdr, sz, contentType, "", s3.Options{})
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(rdr, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		res, err := s3p.do(ref, "PUT", ref.key, nil, header, buf[:n])
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	bs, err := ioutil.ReadAll(rdr)
+	return s3p.putMultipart(ref, header, buf, rdr)
+}
+
+// putMultipart uploads a large file in parts. first is the first part.
+func (s3p *S3Provider) putMultipart(ref s3ref, header http.Header, first []byte, rdr io.Reader) error {
+	res, err := s3p.do(ref, "POST", ref.key, url.Values{"uploads": {""}}, header, nil)
 	if err != nil {
 		return err
 	}
+	var initiated s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error starting multipart upload: %v", err)
+	}
+	uploadID := initiated.UploadID
+
+	abort := func(err error) error {
+		res, aerr := s3p.do(ref, "DELETE", ref.key, url.Values{"uploadId": {uploadID}}, nil, nil)
+		if aerr == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	var complete s3CompleteMultipartUpload
+	part := first
+	for number := 1; ; number++ {
+		res, err := s3p.do(ref, "PUT", ref.key, url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {uploadID},
+		}, nil, part)
+		if err != nil {
+			return abort(fmt.Errorf("error uploading part %d: %v", number, err))
+		}
+		res.Body.Close()
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: number, ETag: res.Header.Get("ETag")})
+
+		n, err := io.ReadFull(rdr, first)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+		part = first[:n]
+	}
 
-	return bucket.Put(ref.path, bs, contentType, "", s3.Options{})
+	body, _ := xml.Marshal(complete)
+	res, err = s3p.do(ref, "POST", ref.key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return abort(fmt.Errorf("error completing multipart upload: %v", err))
+	}
+	defer res.Body.Close()
+	// errors after the upload is complete are reported in the body
+	bs, _ := ioutil.ReadAll(res.Body)
+	var s3err s3Error
+	if xml.Unmarshal(bs, &s3err) == nil && s3err.Code != "" {
+		return abort(s3err)
+	}
+	return nil
 }
 
-func (s3p *S3Provider) List(rawurl string) ([]string, error) {
-	ref := s3p.parse(rawurl)
-	cl := s3.New(ref.auth, ref.region).Bucket(ref.bucket)
-	marker := ""
-	truncated := true
-	names := make([]string, 0)
-	for truncated {
-		res, err := cl.List(rawurl, "/", marker, 1000)
+func (s3p *S3Provider) List(loc Location) ([]string, error) {
+	ref, err := s3p.parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ref.key
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	names := []string{}
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s3p.do(ref, "GET", "", query, nil, nil)
 		if err != nil {
 			return nil, err
 		}
-		for _, key := range res.Contents {
-			names = append(names, key.Key)
+		var result s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid list response: %v", err)
+		}
+		for _, p := range result.CommonPrefixes {
+			names = append(names, strings.TrimPrefix(p.Prefix, prefix))
+		}
+		for _, c := range result.Contents {
+			if c.Key != prefix {
+				names = append(names, strings.TrimPrefix(c.Key, prefix))
+			}
 		}
-		marker = res.NextMarker
-		truncated = res.IsTruncated
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
 	}
+	sort.Strings(names)
 	return names, nil
 }
 
-func (s3p *S3Provider) Version(rawurl, previous string) (string, error) {
-	ref := s3p.parse(rawurl)
-	resp, err := s3.New(ref.auth, ref.region).Bucket(ref.bucket).Head(ref.path, map[string][]string{})
+func (s3p *S3Provider) head(loc Location) (*http.Response, error) {
+	ref, err := s3p.parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s3p.do(ref, "HEAD", ref.key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res, nil
+}
+
+// Version returns the version id of the object in versioned buckets, and its
+// ETag otherwise
+func (s3p *S3Provider) Version(loc Location, previous string) (string, error) {
+	res, err := s3p.head(loc)
 	if err != nil {
 		return "", err
 	}
-	return resp.Header.Get("x-amz-version-id"), nil
+	if v := res.Header.Get("X-Amz-Version-Id"); v != "" && v != "null" {
+		return v, nil
+	}
+	return res.Header.Get("ETag"), nil
+}
+
+func (s3p *S3Provider) Stat(loc Location) (FileInfo, error) {
+	res, err := s3p.head(loc)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi := FileInfo{Size: -1}
+	if res.ContentLength >= 0 {
+		fi.Size = res.ContentLength
+	}
+	fi.ModTime, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	// the ETag of objects uploaded in parts isn't their md5
+	if etag := strings.Trim(res.Header.Get("ETag"), `"`); len(etag) == 32 {
+		fi.Hash = strings.ToLower(etag)
+	}
+	return fi, nil
+}
+
+// sign signs a request with AWS Signature Version 4
+func (creds s3Credentials) sign(req *http.Request, region, payloadHash string, now time.Time) {
+	t := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", t)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	signed := []string{"host"}
+	for k := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-type" || k == "content-md5" || k == "range" {
+			signed = append(signed, k)
+		}
+	}
+	sort.Strings(signed)
+
+	scope := t[:8] + "/" + region + "/s3/aws4_request"
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	signature := creds.signature(req, host, signed, scope, t)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+
+		", Signature="+signature)
+}
+
+// signature computes the signature of a request
+func (creds s3Credentials) signature(req *http.Request, host string, signed []string, scope, t string) string {
+	var canonical bytes.Buffer
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(req.URL.EscapedPath() + "\n")
+	canonical.WriteString(s3Query(req.URL.Query()) + "\n")
+	for _, k := range signed {
+		v := req.Header.Get(k)
+		if k == "host" {
+			v = host
+		}
+		canonical.WriteString(k + ":" + strings.TrimSpace(v) + "\n")
+	}
+	canonical.WriteString("\n" + strings.Join(signed, ";") + "\n")
+	canonical.WriteString(req.Header.Get("X-Amz-Content-Sha256"))
+
+	h := sha256.Sum256(canonical.Bytes())
+	toSign := "AWS4-HMAC-SHA256\n" + t + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	parts := strings.Split(scope, "/")
+	key := []byte("AWS4" + creds.secretKey)
+	for _, part := range parts {
+		key = s3HMAC(key, part)
+	}
+	return hex.EncodeToString(s3HMAC(key, toSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Query encodes a query string in the canonical form
+func s3Query(query url.Values) string {
+	var pairs []string
+	for k, vs := range query {
+		for _, v := range vs {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape escapes everything but unreserved characters, and slashes unless
+// escapeSlash is set
+func s3Escape(s string, escapeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
 }
@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scp://[user[:password]@]{host}[:port]/{path}
+
+type (
+	// SCPProvider copies files with the scp protocol. Listing and deleting
+	// files runs ls and rm, so the server needs a unix shell.
+	SCPProvider struct{}
+
+	// scpSession is a running scp command
+	scpSession struct {
+		client  *ssh.Client
+		session *ssh.Session
+		ref     sshref
+		w       io.WriteCloser
+		r       *bufio.Reader
+	}
+
+	// scpFile reads a file sent by the server
+	scpFile struct {
+		io.Reader
+		s *scpSession
+	}
+)
+
+var SCP = &SCPProvider{}
+
+func init() {
+	Register("scp", SCP)
+}
+
+func (sp *SCPProvider) dial(loc Location) (*ssh.Client, sshref, error) {
+	ref, err := parseSSH(loc)
+	if err != nil {
+		return nil, ref, err
+	}
+	client, err := dialSSH(ref)
+	return client, ref, err
+}
+
+// start runs scp on the server in source (-f) or sink (-t) mode
+func (sp *SCPProvider) start(loc Location, args string) (*scpSession, error) {
+	client, ref, err := sp.dial(loc)
+	if err != nil {
+		return nil, err
+	}
+	s := &scpSession{client: client, ref: ref}
+	s.session, err = client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	w, err := s.session.StdinPipe()
+	if err == nil {
+		var r io.Reader
+		r, err = s.session.StdoutPipe()
+		s.w, s.r = w, bufio.NewReader(r)
+	}
+	if err == nil {
+		err = s.session.Start("scp " + args + " -- " + sshQuote(ref.path))
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error starting scp on %s: %v", ref.addr, err)
+	}
+	return s, nil
+}
+
+func (s *scpSession) Close() error {
+	s.session.Close()
+	return s.client.Close()
+}
+
+// ack reads a response, which is a zero byte or an error message
+func (s *scpSession) ack() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := s.r.ReadString('\n')
+	return s.ref.scpError(strings.TrimSpace(msg))
+}
+
+// header reads a control message from the server, ie "C0644 5 name"
+func (s *scpSession) header() (string, error) {
+	if _, err := s.w.Write([]byte{0}); err != nil {
+		return "", err
+	}
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	switch {
+	case strings.HasPrefix(line, "\x01"), strings.HasPrefix(line, "\x02"):
+		return "", s.ref.scpError(line[1:])
+	case strings.HasPrefix(line, "D"):
+		return "", fmt.Errorf("%s is a folder", s.ref)
+	}
+	return line, nil
+}
+
+// file reads the size from a file header
+func (s *scpSession) file(header string) (int64, error) {
+	fields := strings.SplitN(header, " ", 3)
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "C") {
+		return 0, fmt.Errorf("invalid scp header: %q", header)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid scp header: %q", header)
+	}
+	return size, nil
+}
+
+// scpError converts messages about missing files to not exist errors
+func (ref sshref) scpError(msg string) error {
+	if strings.Contains(msg, "No such file or directory") {
+		return &os.PathError{Op: "scp", Path: ref.String(), Err: os.ErrNotExist}
+	}
+	return fmt.Errorf("scp error: %s", msg)
+}
+
+func (f *scpFile) Close() error {
+	defer f.s.Close()
+	// the file is followed by a status, which the server waits for us to
+	// acknowledge
+	if _, err := io.Copy(ioutil.Discard, f.Reader); err != nil {
+		return err
+	}
+	if err := f.s.ack(); err != nil {
+		return err
+	}
+	_, err := f.s.w.Write([]byte{0})
+	return err
+}
+
+func (sp *SCPProvider) Delete(loc Location) error {
+	client, ref, err := sp.dial(loc)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	p := sshQuote(ref.path)
+	if _, err := sshRun(client, "rm -- "+p+" 2>/dev/null || rmdir -- "+p); err != nil {
+		return ref.scpError(err.Error())
+	}
+	return nil
+}
+
+func (sp *SCPProvider) Get(loc Location) (io.ReadCloser, error) {
+	s, err := sp.start(loc, "-f")
+	if err != nil {
+		return nil, err
+	}
+	header, err := s.header()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	size, err := s.file(header)
+	if err == nil {
+		_, err = s.w.Write([]byte{0})
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &scpFile{Reader: io.LimitReader(s.r, size), s: s}, nil
+}
+
+func (sp *SCPProvider) Put(loc Location, rdr io.Reader) error {
+	// the size has to be sent first, so the file is buffered on disk
+	tmp, err := ioutil.TempFile("", "stack-scp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, rdr)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, 0); err != nil {
+		return err
+	}
+
+	// create the parent folders
+	client, ref, err := sp.dial(loc)
+	if err != nil {
+		return err
+	}
+	dir := path.Dir(ref.path)
+	if dir != "." && dir != "/" {
+		if _, err := sshRun(client, "mkdir -p -- "+sshQuote(dir)); err != nil {
+			client.Close()
+			return fmt.Errorf("error creating %s: %v", dir, err)
+		}
+	}
+	client.Close()
+
+	s, err := sp.start(loc, "-t")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.ack(); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "C0644 %d %s\n", size, path.Base(ref.path)); err != nil {
+		return err
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(s.w, tmp); err != nil {
+		return err
+	}
+	if _, err := s.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	s.w.Close()
+	return s.session.Wait()
+}
+
+func (sp *SCPProvider) List(loc Location) ([]string, error) {
+	client, ref, err := sp.dial(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	// -p marks folders with a slash
+	out, err := sshRun(client, "ls -1Ap -- "+sshQuote(ref.path))
+	if err != nil {
+		return nil, ref.scpError(err.Error())
+	}
+	names := []string{}
+	for _, name := range strings.Split(string(out), "\n") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (sp *SCPProvider) Version(loc Location, previous string) (string, error) {
+	fi, err := sp.Stat(loc)
+	if err != nil {
+		return "", err
+	}
+	return fi.version(), nil
+}
+
+// Stat reads the file headers scp sends when preserving times, without
+// transferring the file
+func (sp *SCPProvider) Stat(loc Location) (FileInfo, error) {
+	s, err := sp.start(loc, "-f -p")
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer s.Close()
+
+	// T<mtime> 0 <atime> 0
+	header, err := s.header()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fields := strings.Fields(strings.TrimPrefix(header, "T"))
+	if !strings.HasPrefix(header, "T") || len(fields) != 4 {
+		return FileInfo{}, fmt.Errorf("invalid scp header: %q", header)
+	}
+	mtime, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("invalid scp header: %q", header)
+	}
+
+	header, err = s.header()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	size, err := s.file(header)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: size, ModTime: time.Unix(mtime, 0).UTC()}, nil
+}
@@ -0,0 +1,7 @@
+package storage
+
+import "testing"
+
+func TestSCPProvider(t *testing.T) {
+	testSSHProvider(t, SCP, "scp")
+}
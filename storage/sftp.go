@@ -0,0 +1,480 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sftp://[user[:password]@]{host}[:port]/{path}
+
+type (
+	SFTPProvider struct{}
+
+	// sftpClient is a client for version 3 of the sftp protocol. Requests
+	// are sent one at a time.
+	sftpClient struct {
+		client  *ssh.Client
+		session *ssh.Session
+		w       io.WriteCloser
+		r       io.Reader
+		ref     sshref
+		id      uint32
+	}
+
+	// sftpError is a status response
+	sftpError struct {
+		Code    uint32
+		Message string
+	}
+
+	sftpFileAttrs struct {
+		size    int64
+		mode    uint32
+		modTime time.Time
+	}
+
+	// sftpFile reads a remote file
+	sftpFile struct {
+		c      *sftpClient
+		handle []byte
+		offset uint64
+	}
+)
+
+var SFTP = &SFTPProvider{}
+
+// sftp packet types, flags and status codes
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpWrite   = 6
+	sftpOpendir = 11
+	sftpReaddir = 12
+	sftpRemove  = 13
+	sftpMkdir   = 14
+	sftpRmdir   = 15
+	sftpStat    = 17
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+	sftpName    = 104
+	sftpAttrs   = 105
+
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+
+	// the largest read or write servers are required to support
+	sftpChunkSize = 32 << 10
+)
+
+func init() {
+	Register("sftp", SFTP)
+}
+
+func (err sftpError) Error() string {
+	return fmt.Sprintf("sftp error: %d %s", err.Code, err.Message)
+}
+
+func (sp *SFTPProvider) dial(loc Location) (*sftpClient, error) {
+	ref, err := parseSSH(loc)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dialSSH(ref)
+	if err != nil {
+		return nil, err
+	}
+	c := &sftpClient{client: client, ref: ref}
+	c.session, err = client.NewSession()
+	if err == nil {
+		c.w, err = c.session.StdinPipe()
+	}
+	if err == nil {
+		c.r, err = c.session.StdoutPipe()
+	}
+	if err == nil {
+		err = c.session.RequestSubsystem("sftp")
+	}
+	if err == nil {
+		err = c.send(sftpInit, []byte{0, 0, 0, 3})
+	}
+	if err == nil {
+		var typ byte
+		typ, _, err = c.recv()
+		if err == nil && typ != sftpVersion {
+			err = fmt.Errorf("unexpected packet %d", typ)
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error starting sftp on %s: %v", ref.addr, err)
+	}
+	return c, nil
+}
+
+func (c *sftpClient) Close() error {
+	if c.session != nil {
+		c.session.Close()
+	}
+	return c.client.Close()
+}
+
+func (c *sftpClient) send(typ byte, data []byte) error {
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = typ
+	_, err := c.w.Write(append(packet, data...))
+	return err
+}
+
+func (c *sftpClient) recv() (byte, []byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > 256<<10 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(c.r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// request sends a request and returns the type and body of the response,
+// converting status responses to errors
+func (c *sftpClient) request(typ byte, payload []byte) (byte, []byte, error) {
+	c.id++
+	data := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(data, c.id)
+	if err := c.send(typ, append(data, payload...)); err != nil {
+		return 0, nil, err
+	}
+	rtyp, res, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(res) < 4 || binary.BigEndian.Uint32(res) != c.id {
+		return 0, nil, fmt.Errorf("unexpected sftp response")
+	}
+	res = res[4:]
+	if rtyp != sftpStatus {
+		return rtyp, res, nil
+	}
+
+	var status sftpError
+	if len(res) < 4 {
+		return 0, nil, fmt.Errorf("invalid sftp status")
+	}
+	status.Code = binary.BigEndian.Uint32(res)
+	if msg, _, ok := sshString(res[4:]); ok {
+		status.Message = string(msg)
+	}
+	switch status.Code {
+	case sftpOK:
+		return rtyp, nil, nil
+	case sftpEOF:
+		return rtyp, nil, io.EOF
+	case sftpNoSuchFile:
+		return rtyp, nil, &os.PathError{Op: "sftp", Path: c.ref.String(), Err: os.ErrNotExist}
+	}
+	return rtyp, nil, status
+}
+
+// expect sends a request that should get a response of the given type
+func (c *sftpClient) expect(expectType, typ byte, payload []byte) ([]byte, error) {
+	rtyp, res, err := c.request(typ, payload)
+	if err != nil {
+		return nil, err
+	}
+	if rtyp != expectType {
+		return nil, fmt.Errorf("unexpected sftp response %d", rtyp)
+	}
+	return res, nil
+}
+
+func (c *sftpClient) open(p string, flags uint32) ([]byte, error) {
+	payload := appendSSHString(nil, []byte(p))
+	payload = appendUint32(payload, flags)
+	payload = appendUint32(payload, 0)
+	res, err := c.expect(sftpHandle, sftpOpen, payload)
+	if err != nil {
+		return nil, err
+	}
+	handle, _, ok := sshString(res)
+	if !ok {
+		return nil, fmt.Errorf("invalid sftp handle")
+	}
+	return handle, nil
+}
+
+func (c *sftpClient) close(handle []byte) error {
+	_, _, err := c.request(sftpClose, appendSSHString(nil, handle))
+	return err
+}
+
+func (c *sftpClient) stat(p string) (sftpFileAttrs, error) {
+	res, err := c.expect(sftpAttrs, sftpStat, appendSSHString(nil, []byte(p)))
+	if err != nil {
+		return sftpFileAttrs{}, err
+	}
+	attrs, _, ok := parseSFTPAttrs(res)
+	if !ok {
+		return attrs, fmt.Errorf("invalid sftp attributes")
+	}
+	return attrs, nil
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if len(p) > sftpChunkSize {
+		p = p[:sftpChunkSize]
+	}
+	payload := appendSSHString(nil, f.handle)
+	payload = appendUint64(payload, f.offset)
+	payload = appendUint32(payload, uint32(len(p)))
+	res, err := f.c.expect(sftpData, sftpRead, payload)
+	if err != nil {
+		return 0, err
+	}
+	data, _, ok := sshString(res)
+	if !ok {
+		return 0, fmt.Errorf("invalid sftp data")
+	}
+	n := copy(p, data)
+	f.offset += uint64(n)
+	return n, nil
+}
+
+func (f *sftpFile) Close() error {
+	err := f.c.close(f.handle)
+	f.c.Close()
+	return err
+}
+
+func (sp *SFTPProvider) Delete(loc Location) error {
+	c, err := sp.dial(loc)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, _, err := c.request(sftpRemove, appendSSHString(nil, []byte(c.ref.path))); err != nil {
+		// folders are removed with RMDIR
+		if _, _, rerr := c.request(sftpRmdir, appendSSHString(nil, []byte(c.ref.path))); rerr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (sp *SFTPProvider) Get(loc Location) (io.ReadCloser, error) {
+	c, err := sp.dial(loc)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := c.open(c.ref.path, sftpFlagRead)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &sftpFile{c: c, handle: handle}, nil
+}
+
+func (sp *SFTPProvider) Put(loc Location, rdr io.Reader) error {
+	c, err := sp.dial(loc)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// create the parent folders, which may already exist
+	var dirs []string
+	for dir := path.Dir(c.ref.path); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		c.request(sftpMkdir, appendUint32(appendSSHString(nil, []byte(dirs[i])), 0))
+	}
+
+	handle, err := c.open(c.ref.path, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sftpChunkSize)
+	var offset uint64
+	for {
+		n, rerr := io.ReadFull(rdr, buf)
+		if n > 0 {
+			payload := appendSSHString(nil, handle)
+			payload = appendUint64(payload, offset)
+			payload = appendSSHString(payload, buf[:n])
+			if _, _, err := c.request(sftpWrite, payload); err != nil {
+				c.close(handle)
+				return err
+			}
+			offset += uint64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			c.close(handle)
+			return rerr
+		}
+	}
+	return c.close(handle)
+}
+
+func (sp *SFTPProvider) List(loc Location) ([]string, error) {
+	c, err := sp.dial(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	res, err := c.expect(sftpHandle, sftpOpendir, appendSSHString(nil, []byte(c.ref.path)))
+	if err != nil {
+		return nil, err
+	}
+	handle, _, ok := sshString(res)
+	if !ok {
+		return nil, fmt.Errorf("invalid sftp handle")
+	}
+	defer c.close(handle)
+
+	names := []string{}
+	for {
+		res, err := c.expect(sftpName, sftpReaddir, appendSSHString(nil, handle))
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(res) < 4 {
+			return nil, fmt.Errorf("invalid sftp names")
+		}
+		count := binary.BigEndian.Uint32(res)
+		rest := res[4:]
+		for i := uint32(0); i < count; i++ {
+			var name []byte
+			var attrs sftpFileAttrs
+			if name, rest, ok = sshString(rest); ok {
+				// the long name is like ls -l
+				_, rest, ok = sshString(rest)
+			}
+			if ok {
+				attrs, rest, ok = parseSFTPAttrs(rest)
+			}
+			if !ok {
+				return nil, fmt.Errorf("invalid sftp names")
+			}
+			if string(name) == "." || string(name) == ".." {
+				continue
+			}
+			if attrs.mode&0170000 == 0040000 {
+				name = append(name, '/')
+			}
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (sp *SFTPProvider) Version(loc Location, previous string) (string, error) {
+	fi, err := sp.Stat(loc)
+	if err != nil {
+		return "", err
+	}
+	return fi.version(), nil
+}
+
+func (sp *SFTPProvider) Stat(loc Location) (FileInfo, error) {
+	c, err := sp.dial(loc)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer c.Close()
+	attrs, err := c.stat(c.ref.path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: attrs.size, ModTime: attrs.modTime}, nil
+}
+
+func parseSFTPAttrs(bs []byte) (attrs sftpFileAttrs, rest []byte, ok bool) {
+	attrs.size = -1
+	if len(bs) < 4 {
+		return attrs, nil, false
+	}
+	flags := binary.BigEndian.Uint32(bs)
+	rest = bs[4:]
+	next := func(n int) []byte {
+		if len(rest) < n {
+			ok = false
+			return make([]byte, n)
+		}
+		field := rest[:n]
+		rest = rest[n:]
+		return field
+	}
+	ok = true
+	if flags&sftpAttrSize != 0 {
+		attrs.size = int64(binary.BigEndian.Uint64(next(8)))
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		next(8)
+	}
+	if flags&sftpAttrPermissions != 0 {
+		attrs.mode = binary.BigEndian.Uint32(next(4))
+	}
+	if flags&sftpAttrACModTime != 0 {
+		next(4)
+		attrs.modTime = time.Unix(int64(binary.BigEndian.Uint32(next(4))), 0).UTC()
+	}
+	if flags&sftpAttrExtended != 0 {
+		count := binary.BigEndian.Uint32(next(4))
+		for i := uint32(0); i < count*2 && ok; i++ {
+			var s bool
+			if _, rest, s = sshString(rest); !s {
+				ok = false
+			}
+		}
+	}
+	return attrs, rest, ok
+}
+
+func appendUint32(bs []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(bs, b[:]...)
+}
+
+func appendUint64(bs []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(bs, b[:]...)
+}
@@ -0,0 +1,7 @@
+package storage
+
+import "testing"
+
+func TestSFTPProvider(t *testing.T) {
+	testSSHProvider(t, SFTP, "sftp")
+}
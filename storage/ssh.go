@@ -0,0 +1,431 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// shared by the sftp and scp providers
+
+type (
+	sshref struct {
+		addr, host, user, password, path string
+		// key is a private key or the path to one
+		key, passphrase string
+		knownHosts      string
+		// hostKey is a fingerprint or public key to trust instead of
+		// known_hosts
+		hostKey string
+	}
+
+	// sshAgent is a client for the ssh-agent protocol
+	sshAgent struct {
+		conn net.Conn
+	}
+
+	sshAgentSigner struct {
+		agent *sshAgent
+		pub   ssh.PublicKey
+	}
+)
+
+var sshTimeout = 30 * time.Second
+
+// ssh agent protocol messages
+const (
+	sshAgentFailure           = 5
+	sshAgentRequestIdentities = 11
+	sshAgentIdentitiesAnswer  = 12
+	sshAgentSignRequest       = 13
+	sshAgentSignResponse      = 14
+)
+
+func parseSSH(loc Location) (sshref, error) {
+	ref := sshref{
+		host:       loc.Host(),
+		user:       loc.Option("user", "SSH_USER", "USER"),
+		password:   loc.Option("password", "SSH_PASSWORD"),
+		key:        loc.Option("key", "SSH_KEY"),
+		passphrase: loc.Option("passphrase", "SSH_PASSPHRASE"),
+		knownHosts: loc.Option("known_hosts", "SSH_KNOWN_HOSTS"),
+		hostKey:    loc.Option("host_key", "SSH_HOST_KEY"),
+	}
+	if ref.host == "" {
+		return ref, fmt.Errorf("%s host is required", loc.Type())
+	}
+	ref.addr = ref.host
+	if h, _, err := net.SplitHostPort(ref.host); err == nil {
+		ref.host = h
+	} else {
+		ref.addr = net.JoinHostPort(ref.host, "22")
+	}
+	if ref.user == "" {
+		return ref, fmt.Errorf("%s user is required", loc.Type())
+	}
+	if ref.knownHosts == "" {
+		ref.knownHosts = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
+
+	// like curl, paths are absolute unless they start with /~/
+	ref.path = loc.Path()
+	if strings.HasPrefix(ref.path, "/~/") || ref.path == "/~" {
+		ref.path = strings.TrimPrefix(strings.TrimPrefix(ref.path, "/~"), "/")
+	}
+	if ref.path == "" {
+		ref.path = "."
+	}
+	return ref, nil
+}
+
+func (ref sshref) String() string {
+	p := ref.path
+	if !strings.HasPrefix(p, "/") {
+		p = "/~/" + p
+	}
+	return ref.user + "@" + ref.addr + p
+}
+
+// dialSSH connects to the server, trying keys, the agent and then the
+// password
+func dialSSH(ref sshref) (*ssh.Client, error) {
+	var signers []ssh.Signer
+	if ref.key != "" {
+		signer, err := sshSigner(ref.key, ref.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.DialTimeout("unix", sock, sshTimeout); err == nil {
+			defer conn.Close()
+			agent := &sshAgent{conn: conn}
+			if agentSigners, err := agent.signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	if ref.key == "" {
+		// the default keys are skipped if they can't be used
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			if signer, err := sshSigner(filepath.Join(os.Getenv("HOME"), ".ssh", name), ref.passphrase); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+
+	var auth []ssh.AuthMethod
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if ref.password != "" {
+		auth = append(auth, ssh.Password(ref.password))
+		auth = append(auth, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = ref.password
+			}
+			return answers, nil
+		}))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no ssh key, agent or password for %s", ref.addr)
+	}
+
+	client, err := ssh.Dial("tcp", ref.addr, &ssh.ClientConfig{
+		User:            ref.user,
+		Auth:            auth,
+		HostKeyCallback: ref.hostKeyCallback(),
+		Timeout:         sshTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", ref.addr, err)
+	}
+	return client, nil
+}
+
+// sshSigner reads a private key from a file or the key itself
+func sshSigner(key, passphrase string) (ssh.Signer, error) {
+	bs := []byte(key)
+	if !strings.Contains(key, "PRIVATE KEY") {
+		if strings.HasPrefix(key, "~/") {
+			key = filepath.Join(os.Getenv("HOME"), key[2:])
+		}
+		var err error
+		bs, err = ioutil.ReadFile(key)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ssh key: %v", err)
+		}
+	}
+	var signer ssh.Signer
+	var err error
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(bs, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(bs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh key: %v", err)
+	}
+	return signer, nil
+}
+
+// hostKeyCallback verifies the server's key against the pinned host key or
+// known_hosts
+func (ref sshref) hostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if ref.hostKey != "" {
+			if ref.hostKey == ssh.FingerprintSHA256(key) {
+				return nil
+			}
+			if pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ref.hostKey)); err == nil && bytes.Equal(pinned.Marshal(), key.Marshal()) {
+				return nil
+			}
+			return fmt.Errorf("host key %s doesn't match %s", ssh.FingerprintSHA256(key), ref.hostKey)
+		}
+		bs, err := ioutil.ReadFile(ref.knownHosts)
+		if err != nil {
+			return fmt.Errorf("error reading known hosts: %v", err)
+		}
+		return sshKnownHost(bs, ref.addr, key)
+	}
+}
+
+// sshKnownHost checks a host key against the contents of a known_hosts file
+func sshKnownHost(knownHosts []byte, addr string, key ssh.PublicKey) error {
+	host, port, _ := net.SplitHostPort(addr)
+	name := host
+	if port != "22" {
+		name = "[" + host + "]:" + port
+	}
+
+	found, trusted := false, false
+	for rest := knownHosts; len(rest) > 0; {
+		marker, hosts, pub, _, next, err := ssh.ParseKnownHosts(rest)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("invalid known hosts: %v", err)
+		}
+		rest = next
+		if marker == "cert-authority" || !sshMatchHosts(hosts, name) {
+			continue
+		}
+		same := bytes.Equal(pub.Marshal(), key.Marshal())
+		if marker == "revoked" {
+			if same {
+				return fmt.Errorf("host key %s for %s is revoked", ssh.FingerprintSHA256(key), name)
+			}
+			continue
+		}
+		found = true
+		trusted = trusted || same
+	}
+	if trusted {
+		return nil
+	} else if found {
+		return fmt.Errorf("host key %s for %s doesn't match known hosts", ssh.FingerprintSHA256(key), name)
+	}
+	return fmt.Errorf("%s is not a known host", name)
+}
+
+// sshMatchHosts matches a host against the patterns of a known_hosts line,
+// which may be hashed, wildcards or negated
+func sshMatchHosts(patterns []string, name string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+		if strings.HasPrefix(pattern, "|1|") {
+			// |1|base64(salt)|base64(hmac-sha1(salt, host))
+			parts := strings.Split(pattern, "|")
+			if len(parts) == 4 {
+				salt, err1 := base64.StdEncoding.DecodeString(parts[2])
+				hash, err2 := base64.StdEncoding.DecodeString(parts[3])
+				if err1 == nil && err2 == nil {
+					mac := hmac.New(sha1.New, salt)
+					mac.Write([]byte(name))
+					ok = hmac.Equal(mac.Sum(nil), hash)
+				}
+			}
+		} else {
+			ok = sshGlob(strings.ToLower(pattern), strings.ToLower(name))
+		}
+
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// sshGlob matches a pattern where * matches any characters and ? matches
+// one. Unlike path.Match, brackets are literal as in "[host]:2222".
+func sshGlob(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if sshGlob(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// sshQuote quotes an argument for a remote shell
+func sshQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// sshRun runs a command and returns its output, or stderr as the error
+func sshRun(client *ssh.Client, cmd string) ([]byte, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	out, err := session.Output(cmd)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return out, fmt.Errorf("%s", msg)
+		}
+		return out, err
+	}
+	return out, nil
+}
+
+func (a *sshAgent) request(msg []byte) ([]byte, error) {
+	a.conn.SetDeadline(time.Now().Add(sshTimeout))
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(msg)))
+	if _, err := a.conn.Write(append(size[:], msg...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(a.conn, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > 256<<10 {
+		return nil, fmt.Errorf("invalid ssh agent response")
+	}
+	res := make([]byte, n)
+	if _, err := io.ReadFull(a.conn, res); err != nil {
+		return nil, err
+	}
+	if res[0] == sshAgentFailure {
+		return nil, fmt.Errorf("ssh agent failure")
+	}
+	return res, nil
+}
+
+// signers returns the agent's keys
+func (a *sshAgent) signers() ([]ssh.Signer, error) {
+	res, err := a.request([]byte{sshAgentRequestIdentities})
+	if err != nil {
+		return nil, err
+	}
+	if res[0] != sshAgentIdentitiesAnswer || len(res) < 5 {
+		return nil, fmt.Errorf("invalid ssh agent response")
+	}
+	n := binary.BigEndian.Uint32(res[1:])
+	rest := res[5:]
+	var signers []ssh.Signer
+	for i := uint32(0); i < n; i++ {
+		var blob []byte
+		var ok bool
+		if blob, rest, ok = sshString(rest); !ok {
+			return nil, fmt.Errorf("invalid ssh agent response")
+		}
+		// the comment
+		if _, rest, ok = sshString(rest); !ok {
+			return nil, fmt.Errorf("invalid ssh agent response")
+		}
+		pub, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			// unsupported key types are skipped
+			continue
+		}
+		signers = append(signers, &sshAgentSigner{agent: a, pub: pub})
+	}
+	return signers, nil
+}
+
+func (s *sshAgentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *sshAgentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	msg := []byte{sshAgentSignRequest}
+	msg = appendSSHString(msg, s.pub.Marshal())
+	msg = appendSSHString(msg, data)
+	msg = append(msg, 0, 0, 0, 0)
+	res, err := s.agent.request(msg)
+	if err != nil {
+		return nil, err
+	}
+	if res[0] != sshAgentSignResponse {
+		return nil, fmt.Errorf("invalid ssh agent response")
+	}
+	blob, _, ok := sshString(res[1:])
+	if !ok {
+		return nil, fmt.Errorf("invalid ssh agent response")
+	}
+	format, rest, ok := sshString(blob)
+	if !ok {
+		return nil, fmt.Errorf("invalid ssh agent signature")
+	}
+	sig, _, ok := sshString(rest)
+	if !ok {
+		return nil, fmt.Errorf("invalid ssh agent signature")
+	}
+	return &ssh.Signature{Format: string(format), Blob: sig}, nil
+}
+
+// sshString reads a length prefixed string
+func sshString(bs []byte) (s, rest []byte, ok bool) {
+	if len(bs) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(bs)
+	if uint32(len(bs)-4) < n {
+		return nil, nil, false
+	}
+	return bs[4 : 4+n], bs[4+n:], true
+}
+
+func appendSSHString(bs, s []byte) []byte {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(s)))
+	return append(append(bs, size[:]...), s...)
+}
@@ -0,0 +1,798 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSSHKey(t *testing.T) (*ecdsa.PrivateKey, ssh.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, signer
+}
+
+func sshKeyPEM(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// fakeSSH is an in-process ssh server with an sftp subsystem and enough of
+// a shell to run scp, ls, rm, rmdir and mkdir
+type fakeSSH struct {
+	ln       net.Listener
+	hostKey  ssh.Signer
+	home     string
+	password string
+
+	mu         sync.Mutex
+	authorized []ssh.PublicKey
+}
+
+func newFakeSSH(t *testing.T, home string) *fakeSSH {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hostKey := newSSHKey(t)
+	f := &fakeSSH{ln: ln, hostKey: hostKey, home: home, password: "secret"}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "user" && string(password) == f.password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wrong password")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for _, k := range f.authorized {
+				if conn.User() == "user" && bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn, config)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSSH) Close() error {
+	return f.ln.Close()
+}
+
+// knownHosts writes a known_hosts file for the server
+func (f *fakeSSH) knownHosts(t *testing.T, dir string) string {
+	_, port, _ := net.SplitHostPort(f.ln.Addr().String())
+	p := filepath.Join(dir, "known_hosts")
+	line := "[127.0.0.1]:" + port + " " + string(ssh.MarshalAuthorizedKey(f.hostKey.PublicKey()))
+	if err := ioutil.WriteFile(p, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func (f *fakeSSH) handle(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range chReqs {
+				payload, _, _ := sshString(req.Payload)
+				switch req.Type {
+				case "subsystem":
+					if string(payload) != "sftp" {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+					f.sftp(ch)
+					return
+				case "exec":
+					req.Reply(true, nil)
+					status := f.exec(ch, string(payload))
+					ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+					return
+				default:
+					req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+func (f *fakeSSH) resolve(p string) string {
+	if !filepath.IsAbs(p) {
+		return filepath.Join(f.home, p)
+	}
+	return p
+}
+
+// shellSplit splits a command into words, handling single quotes
+func shellSplit(cmd string) []string {
+	var words []string
+	var word []byte
+	inWord, quoted := false, false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case quoted && c == '\'':
+			quoted = false
+		case quoted:
+			word = append(word, c)
+		case c == '\'':
+			quoted, inWord = true, true
+		case c == '\\' && i+1 < len(cmd):
+			i++
+			word, inWord = append(word, cmd[i]), true
+		case c == ' ':
+			if inWord {
+				words = append(words, string(word))
+			}
+			word, inWord = nil, false
+		default:
+			word, inWord = append(word, c), true
+		}
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+// exec runs the commands the scp provider uses and returns the exit status
+func (f *fakeSSH) exec(ch ssh.Channel, cmd string) int {
+	args := shellSplit(cmd)
+	stderr := func(format string, args ...interface{}) {
+		fmt.Fprintf(ch.Stderr(), format+"\n", args...)
+	}
+	switch {
+	case len(args) == 5 && args[0] == "scp" && args[1] == "-f" && args[3] == "--" && args[2] == "-p":
+		return f.scpSource(ch, f.resolve(args[4]), true)
+	case len(args) == 4 && args[0] == "scp" && args[1] == "-f" && args[2] == "--":
+		return f.scpSource(ch, f.resolve(args[3]), false)
+	case len(args) == 4 && args[0] == "scp" && args[1] == "-t" && args[2] == "--":
+		return f.scpSink(ch, f.resolve(args[3]))
+	case len(args) == 4 && args[0] == "mkdir" && args[1] == "-p" && args[2] == "--":
+		if err := os.MkdirAll(f.resolve(args[3]), 0755); err != nil {
+			stderr("mkdir: %v", err)
+			return 1
+		}
+		return 0
+	case len(args) == 4 && args[0] == "ls" && args[1] == "-1Ap" && args[2] == "--":
+		p := f.resolve(args[3])
+		fi, err := os.Stat(p)
+		if err != nil {
+			stderr("ls: cannot access '%s': No such file or directory", args[3])
+			return 2
+		}
+		if !fi.IsDir() {
+			fmt.Fprintln(ch, args[3])
+			return 0
+		}
+		fis, _ := ioutil.ReadDir(p)
+		for _, fi := range fis {
+			if fi.IsDir() {
+				fmt.Fprintln(ch, fi.Name()+"/")
+			} else {
+				fmt.Fprintln(ch, fi.Name())
+			}
+		}
+		return 0
+	case len(args) == 8 && args[0] == "rm" && args[3] == "2>/dev/null" && args[4] == "||" && args[5] == "rmdir":
+		p := f.resolve(args[2])
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			os.Remove(p)
+			return 0
+		}
+		fi, err := os.Stat(p)
+		switch {
+		case os.IsNotExist(err):
+			stderr("rmdir: failed to remove '%s': No such file or directory", args[7])
+			return 1
+		case err == nil && fi.IsDir():
+			if err := os.Remove(p); err != nil {
+				stderr("rmdir: failed to remove '%s': Directory not empty", args[7])
+				return 1
+			}
+			return 0
+		}
+		stderr("rm: %v", err)
+		return 1
+	}
+	stderr("sh: %s: command not found", args[0])
+	return 127
+}
+
+func (f *fakeSSH) scpSource(ch ssh.Channel, p string, preserve bool) int {
+	r := bufio.NewReader(ch)
+	ack := func() bool {
+		b, err := r.ReadByte()
+		return err == nil && b == 0
+	}
+	if !ack() {
+		return 1
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		fmt.Fprintf(ch, "\x01scp: %s: No such file or directory\n", p)
+		return 1
+	}
+	if fi.IsDir() {
+		fmt.Fprintf(ch, "\x01scp: %s: not a regular file\n", p)
+		return 1
+	}
+	if preserve {
+		fmt.Fprintf(ch, "T%d 0 %d 0\n", fi.ModTime().Unix(), fi.ModTime().Unix())
+		if !ack() {
+			return 1
+		}
+	}
+	fmt.Fprintf(ch, "C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), filepath.Base(p))
+	if !ack() {
+		return 1
+	}
+	data, _ := ioutil.ReadFile(p)
+	ch.Write(data)
+	ch.Write([]byte{0})
+	if !ack() {
+		return 1
+	}
+	return 0
+}
+
+func (f *fakeSSH) scpSink(ch ssh.Channel, p string) int {
+	r := bufio.NewReader(ch)
+	ch.Write([]byte{0})
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 1
+	}
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "C") {
+		fmt.Fprintf(ch, "\x02scp: protocol error: %s\n", line)
+		return 1
+	}
+	size, _ := strconv.ParseInt(fields[1], 10, 64)
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		p = filepath.Join(p, fields[2])
+	}
+	if _, err := os.Stat(filepath.Dir(p)); err != nil {
+		fmt.Fprintf(ch, "\x01scp: %s: No such file or directory\n", p)
+		return 1
+	}
+	ch.Write([]byte{0})
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 1
+	}
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return 1
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		fmt.Fprintf(ch, "\x01scp: %s: %v\n", p, err)
+		return 1
+	}
+	ch.Write([]byte{0})
+	return 0
+}
+
+// sftp serves version 3 of the sftp protocol from the filesystem
+func (f *fakeSSH) sftp(ch ssh.Channel) {
+	send := func(typ byte, id uint32, data []byte) {
+		payload := appendUint32(nil, id)
+		packet := appendUint32(nil, uint32(1+4+len(data)))
+		packet = append(packet, typ)
+		ch.Write(append(append(packet, payload...), data...))
+	}
+	status := func(id uint32, err error) {
+		code := uint32(sftpOK)
+		msg := "ok"
+		switch {
+		case err == io.EOF:
+			code, msg = sftpEOF, "eof"
+		case os.IsNotExist(err):
+			code, msg = sftpNoSuchFile, "no such file"
+		case os.IsPermission(err):
+			code, msg = 3, "permission denied"
+		case err != nil:
+			code, msg = 4, err.Error()
+		}
+		data := appendUint32(nil, code)
+		data = appendSSHString(data, []byte(msg))
+		data = appendSSHString(data, nil)
+		send(sftpStatus, id, data)
+	}
+	attrs := func(fi os.FileInfo) []byte {
+		mode := uint32(fi.Mode().Perm())
+		if fi.IsDir() {
+			mode |= 0040000
+		} else {
+			mode |= 0100000
+		}
+		data := appendUint32(nil, sftpAttrSize|sftpAttrUIDGID|sftpAttrPermissions|sftpAttrACModTime|sftpAttrExtended)
+		data = appendUint64(data, uint64(fi.Size()))
+		data = appendUint32(appendUint32(data, 1000), 1000)
+		data = appendUint32(data, mode)
+		data = appendUint32(appendUint32(data, uint32(fi.ModTime().Unix())), uint32(fi.ModTime().Unix()))
+		data = appendUint32(data, 1)
+		data = appendSSHString(appendSSHString(data, []byte("test@example.com")), []byte("1"))
+		return data
+	}
+
+	type entry struct {
+		name string
+		fi   os.FileInfo
+	}
+	files := map[string]*os.File{}
+	dirs := map[string][]entry{}
+	handles := 0
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(ch, size[:]); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(ch, packet); err != nil {
+			return
+		}
+		typ := packet[0]
+		if typ == sftpInit {
+			ch.Write([]byte{0, 0, 0, 5, sftpVersion, 0, 0, 0, 3})
+			continue
+		}
+		id := binary.BigEndian.Uint32(packet[1:])
+		arg, rest, _ := sshString(packet[5:])
+		p := f.resolve(string(arg))
+
+		switch typ {
+		case sftpOpen:
+			flags := binary.BigEndian.Uint32(rest)
+			oflags := os.O_RDONLY
+			if flags&sftpFlagWrite != 0 {
+				oflags = os.O_WRONLY
+			}
+			if flags&sftpFlagCreat != 0 {
+				oflags |= os.O_CREATE
+			}
+			if flags&sftpFlagTrunc != 0 {
+				oflags |= os.O_TRUNC
+			}
+			file, err := os.OpenFile(p, oflags, 0644)
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			handles++
+			handle := strconv.Itoa(handles)
+			files[handle] = file
+			send(sftpHandle, id, appendSSHString(nil, []byte(handle)))
+		case sftpClose:
+			if file, ok := files[string(arg)]; ok {
+				status(id, file.Close())
+				delete(files, string(arg))
+			} else {
+				delete(dirs, string(arg))
+				status(id, nil)
+			}
+		case sftpRead:
+			offset := binary.BigEndian.Uint64(rest)
+			buf := make([]byte, binary.BigEndian.Uint32(rest[8:]))
+			n, err := files[string(arg)].ReadAt(buf, int64(offset))
+			if n == 0 && err != nil {
+				status(id, err)
+				continue
+			}
+			send(sftpData, id, appendSSHString(nil, buf[:n]))
+		case sftpWrite:
+			offset := binary.BigEndian.Uint64(rest)
+			data, _, _ := sshString(rest[8:])
+			_, err := files[string(arg)].WriteAt(data, int64(offset))
+			status(id, err)
+		case sftpOpendir:
+			fis, err := ioutil.ReadDir(p)
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			handles++
+			handle := strconv.Itoa(handles)
+			dot, _ := os.Stat(p)
+			entries := []entry{{".", dot}}
+			for _, fi := range fis {
+				entries = append(entries, entry{fi.Name(), fi})
+			}
+			dirs[handle] = entries
+			send(sftpHandle, id, appendSSHString(nil, []byte(handle)))
+		case sftpReaddir:
+			entries := dirs[string(arg)]
+			if len(entries) == 0 {
+				status(id, io.EOF)
+				continue
+			}
+			// two at a time, like a server with a small buffer
+			if len(entries) > 2 {
+				entries = entries[:2]
+			}
+			dirs[string(arg)] = dirs[string(arg)][len(entries):]
+			data := appendUint32(nil, uint32(len(entries)))
+			for _, e := range entries {
+				data = appendSSHString(data, []byte(e.name))
+				data = appendSSHString(data, []byte(e.fi.Mode().String()+" "+e.name))
+				data = append(data, attrs(e.fi)...)
+			}
+			send(sftpName, id, data)
+		case sftpStat:
+			fi, err := os.Stat(p)
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			send(sftpAttrs, id, attrs(fi))
+		case sftpRemove:
+			// like unlink, folders can't be removed
+			if fi, err := os.Lstat(p); err == nil && fi.IsDir() {
+				status(id, fmt.Errorf("is a folder"))
+				continue
+			}
+			status(id, os.Remove(p))
+		case sftpMkdir:
+			status(id, os.Mkdir(p, 0755))
+		case sftpRmdir:
+			if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+				status(id, fmt.Errorf("not a folder"))
+				continue
+			}
+			status(id, os.Remove(p))
+		default:
+			status(id, fmt.Errorf("unsupported"))
+		}
+	}
+}
+
+// fakeSSHAgent serves the agent protocol on a unix socket
+func fakeSSHAgent(t *testing.T, dir string, signers ...ssh.Signer) (string, net.Listener) {
+	sock := filepath.Join(dir, "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					msg := make([]byte, binary.BigEndian.Uint32(size[:]))
+					if _, err := io.ReadFull(conn, msg); err != nil {
+						return
+					}
+					res := []byte{sshAgentFailure}
+					switch msg[0] {
+					case sshAgentRequestIdentities:
+						res = appendUint32([]byte{sshAgentIdentitiesAnswer}, uint32(len(signers)))
+						for _, s := range signers {
+							res = appendSSHString(res, s.PublicKey().Marshal())
+							res = appendSSHString(res, []byte("test key"))
+						}
+					case sshAgentSignRequest:
+						blob, rest, _ := sshString(msg[1:])
+						data, _, _ := sshString(rest)
+						for _, s := range signers {
+							if bytes.Equal(s.PublicKey().Marshal(), blob) {
+								sig, err := s.Sign(rand.Reader, data)
+								if err == nil {
+									res = appendSSHString([]byte{sshAgentSignResponse}, ssh.Marshal(*sig))
+								}
+							}
+						}
+					}
+					conn.Write(appendUint32(nil, uint32(len(res))))
+					conn.Write(res)
+				}
+			}()
+		}
+	}()
+	return sock, ln
+}
+
+func TestSSHKnownHost(t *testing.T) {
+	assert := assert.New(t)
+	_, signer := newSSHKey(t)
+	_, other := newSSHKey(t)
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	otherKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(other.PublicKey())))
+
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("hashed.example.com"))
+	hashed := "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	knownHosts := []byte(strings.Join([]string{
+		"# comment",
+		"example.com,192.0.2.1 " + key,
+		"[example.com]:2222 " + otherKey,
+		hashed + " " + key,
+		"*.example.org,!bad.example.org " + key,
+		"@revoked revoked.example.org " + key,
+		"@cert-authority *.example.net " + key,
+	}, "\n"))
+
+	cases := []struct {
+		addr, err string
+	}{
+		{"example.com:22", ""},
+		{"EXAMPLE.com:22", ""},
+		{"192.0.2.1:22", ""},
+		{"example.com:2222", "doesn't match"},
+		{"hashed.example.com:22", ""},
+		{"www.example.org:22", ""},
+		{"bad.example.org:22", "not a known host"},
+		{"revoked.example.org:22", "revoked"},
+		{"www.example.net:22", "not a known host"},
+		{"other.example.com:22", "not a known host"},
+	}
+	for _, c := range cases {
+		err := sshKnownHost(knownHosts, c.addr, signer.PublicKey())
+		if c.err == "" {
+			assert.Nil(err, c.addr)
+		} else {
+			assert.Contains(fmt.Sprint(err), c.err, c.addr)
+		}
+	}
+	assert.Nil(sshKnownHost(knownHosts, "example.com:2222", other.PublicKey()))
+}
+
+func TestSSHParse(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Setenv("SSH_USER", os.Getenv("SSH_USER"))
+	os.Setenv("SSH_USER", "deploy")
+
+	loc, _ := ParseLocation("sftp://bob@example.com/srv/builds/app.tgz")
+	ref, err := parseSSH(loc)
+	assert.Nil(err)
+	assert.Equal("example.com:22", ref.addr)
+	assert.Equal("bob", ref.user)
+	assert.Equal("/srv/builds/app.tgz", ref.path)
+
+	loc, _ = ParseLocation("scp://example.com:2222/~/builds/app.tgz?known_hosts=/tmp/known_hosts")
+	ref, err = parseSSH(loc)
+	assert.Nil(err)
+	assert.Equal("example.com:2222", ref.addr)
+	assert.Equal("deploy", ref.user)
+	assert.Equal("builds/app.tgz", ref.path)
+	assert.Equal("/tmp/known_hosts", ref.knownHosts)
+	assert.Equal("deploy@example.com:2222/~/builds/app.tgz", ref.String())
+
+	loc, _ = ParseLocation("sftp://example.com/~")
+	ref, err = parseSSH(loc)
+	assert.Nil(err)
+	assert.Equal(".", ref.path)
+
+	assert.Equal(`'it'\''s here'`, sshQuote("it's here"))
+	assert.Equal([]string{"it's here", "a"}, shellSplit(sshQuote("it's here")+" a"))
+}
+
+func TestSSHAuth(t *testing.T) {
+	assert := assert.New(t)
+	tmp, err := ioutil.TempDir("", "stack-ssh-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+	os.Setenv("HOME", tmp)
+
+	f := newFakeSSH(t, tmp)
+	defer f.Close()
+	knownHosts := f.knownHosts(t, tmp)
+	ioutil.WriteFile(filepath.Join(tmp, "a.txt"), []byte("a"), 0644)
+
+	key, signer := newSSHKey(t)
+	keyFile := filepath.Join(tmp, "id_ecdsa_test")
+	ioutil.WriteFile(keyFile, []byte(sshKeyPEM(t, key)), 0600)
+	f.authorized = append(f.authorized, signer.PublicKey())
+
+	stat := func(loc Location) error {
+		loc["type"], loc["host"], loc["path"] = "sftp", f.ln.Addr().String(), "/~/a.txt"
+		if loc["user"] == "" {
+			loc["user"] = "user"
+		}
+		if loc["known_hosts"] == "" {
+			loc["known_hosts"] = knownHosts
+		}
+		_, err := SFTP.Stat(loc)
+		return err
+	}
+
+	assert.Nil(stat(Location{"password": "secret"}), "password")
+	assert.Contains(fmt.Sprint(stat(Location{"password": "wrong"})), "unable to authenticate")
+	assert.Contains(fmt.Sprint(stat(Location{})), "no ssh key, agent or password")
+	assert.Nil(stat(Location{"key": keyFile}), "key file")
+	assert.Nil(stat(Location{"key": sshKeyPEM(t, key)}), "key")
+	_, unknown := newSSHKey(t)
+	assert.Contains(fmt.Sprint(stat(Location{"user": "other", "key": keyFile})), "unable to authenticate")
+
+	// the agent
+	sock, ln := fakeSSHAgent(t, tmp, unknown, signer)
+	defer ln.Close()
+	os.Setenv("SSH_AUTH_SOCK", sock)
+	assert.Nil(stat(Location{}), "agent")
+	os.Unsetenv("SSH_AUTH_SOCK")
+
+	// default keys
+	os.MkdirAll(filepath.Join(tmp, ".ssh"), 0700)
+	ioutil.WriteFile(filepath.Join(tmp, ".ssh", "id_ecdsa"), []byte(sshKeyPEM(t, key)), 0600)
+	assert.Nil(stat(Location{}), "default key")
+	os.Remove(filepath.Join(tmp, ".ssh", "id_ecdsa"))
+
+	// host keys
+	assert.Contains(fmt.Sprint(stat(Location{"password": "secret", "known_hosts": filepath.Join(tmp, "missing")})), "known hosts")
+	empty := filepath.Join(tmp, "empty_known_hosts")
+	ioutil.WriteFile(empty, nil, 0600)
+	assert.Contains(fmt.Sprint(stat(Location{"password": "secret", "known_hosts": empty})), "is not a known host")
+	assert.Nil(stat(Location{"password": "secret", "known_hosts": empty, "host_key": ssh.FingerprintSHA256(f.hostKey.PublicKey())}))
+	assert.Nil(stat(Location{"password": "secret", "known_hosts": empty, "host_key": string(ssh.MarshalAuthorizedKey(f.hostKey.PublicKey()))}))
+	assert.Contains(fmt.Sprint(stat(Location{"password": "secret", "host_key": ssh.FingerprintSHA256(unknown.PublicKey())})), "doesn't match")
+}
+
+// sshProvider is implemented by the sftp and scp providers
+type sshProvider interface {
+	Getter
+	Putter
+	Lister
+	Versioner
+	Stater
+	Delete(Location) error
+}
+
+func testSSHProvider(t *testing.T, p sshProvider, scheme string) {
+	assert := assert.New(t)
+	tmp, err := ioutil.TempDir("", "stack-"+scheme+"-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+
+	home := filepath.Join(tmp, "home")
+	os.Mkdir(home, 0755)
+	f := newFakeSSH(t, home)
+	defer f.Close()
+	knownHosts := f.knownHosts(t, tmp)
+	loc := func(p string) Location {
+		l, _ := ParseLocation(scheme + "://user:secret@" + f.ln.Addr().String() + p + "?known_hosts=" + knownHosts)
+		return l
+	}
+	root := filepath.ToSlash(filepath.Join(tmp, "srv"))
+
+	// put creates the folders
+	assert.Nil(p.Put(loc(root+"/releases/v1/app's.tgz"), strings.NewReader("hello")))
+	bs, _ := ioutil.ReadFile(filepath.Join(tmp, "srv", "releases", "v1", "app's.tgz"))
+	assert.Equal("hello", string(bs))
+	rc, err := p.Get(loc(root + "/releases/v1/app's.tgz"))
+	if assert.Nil(err) {
+		bs, _ := ioutil.ReadAll(rc)
+		assert.Nil(rc.Close())
+		assert.Equal("hello", string(bs))
+	}
+
+	// larger files
+	big := bytes.Repeat([]byte("0123456789"), 10000)
+	assert.Nil(p.Put(loc(root+"/big.bin"), bytes.NewReader(big)))
+	rc, err = p.Get(loc(root + "/big.bin"))
+	if assert.Nil(err) {
+		bs, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(big, bs)
+	}
+
+	// paths relative to the home folder
+	assert.Nil(p.Put(loc("/~/notes.txt"), strings.NewReader("notes")))
+	bs, _ = ioutil.ReadFile(filepath.Join(home, "notes.txt"))
+	assert.Equal("notes", string(bs))
+
+	// version and stat
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(tmp, "srv", "releases", "v1", "app's.tgz"), mtime, mtime)
+	version, err := p.Version(loc(root+"/releases/v1/app's.tgz"), "")
+	assert.Nil(err)
+	assert.Equal("20200102030405-5", version)
+	fi, err := p.Stat(loc(root + "/releases/v1/app's.tgz"))
+	assert.Nil(err)
+	assert.Equal(FileInfo{Size: 5, ModTime: mtime}, fi)
+
+	// missing files
+	_, err = p.Get(loc(root + "/missing.tgz"))
+	assert.True(os.IsNotExist(err), "expected not exist, got %v", err)
+	_, err = p.Version(loc(root+"/missing.tgz"), "")
+	assert.True(os.IsNotExist(err), "expected not exist, got %v", err)
+	_, err = p.List(loc(root + "/missing"))
+	assert.True(os.IsNotExist(err), "expected not exist, got %v", err)
+
+	// list
+	assert.Nil(p.Put(loc(root+"/releases/v1 notes.txt"), strings.NewReader("notes")))
+	assert.Nil(p.Put(loc(root+"/releases/v2/app.tgz"), strings.NewReader("v2")))
+	names, err := p.List(loc(root + "/releases"))
+	assert.Nil(err)
+	assert.Equal([]string{"v1 notes.txt", "v1/", "v2/"}, names)
+	names, err = p.List(loc("/~"))
+	assert.Nil(err)
+	assert.Equal([]string{"notes.txt"}, names)
+
+	// delete files and empty folders
+	assert.Nil(p.Delete(loc(root + "/releases/v1/app's.tgz")))
+	assert.Nil(p.Delete(loc(root + "/releases/v1")))
+	assert.NotNil(p.Delete(loc(root + "/releases/v2")))
+	names, err = p.List(loc(root + "/releases"))
+	assert.Nil(err)
+	assert.Equal([]string{"v1 notes.txt", "v2/"}, names)
+	assert.True(os.IsNotExist(p.Delete(loc(root + "/missing.tgz"))))
+}
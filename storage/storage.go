@@ -5,6 +5,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
+
+	"github.com/badgerodon/stack/logging"
 )
 
 type (
@@ -13,7 +16,7 @@ type (
 		Get(location Location) (io.ReadCloser, error)
 	}
 
-	// A Lister can list files
+	// A Lister can list files. Folders end in a slash.
 	Lister interface {
 		List(Location) ([]string, error)
 	}
@@ -27,6 +30,27 @@ type (
 		Version(location Location, previous string) (string, error)
 	}
 
+	// A Stater can describe a file without downloading it
+	Stater interface {
+		Stat(location Location) (FileInfo, error)
+	}
+
+	// FileInfo describes a file. Size is -1 and Hash is empty if they aren't
+	// known.
+	FileInfo struct {
+		Size    int64
+		ModTime time.Time
+		// Hash is the hex encoded md5 of the file
+		Hash string
+	}
+
+	// A Watcher can report changes to a location as they happen instead of
+	// having to be polled. A value is sent on the returned channel after
+	// every change until done is closed.
+	Watcher interface {
+		Watch(location Location, done <-chan struct{}) (<-chan struct{}, error)
+	}
+
 	AuthProvider interface {
 		Authenticate()
 	}
@@ -66,6 +90,8 @@ var (
 	putters    = map[string]Putter{}
 	listers    = map[string]Lister{}
 	versioners = map[string]Versioner{}
+	staters    = map[string]Stater{}
+	watchers   = map[string]Watcher{}
 )
 
 func RegisterAuth(scheme string, authProvider AuthProvider) {
@@ -86,6 +112,12 @@ func Register(scheme string, provider interface{}) {
 	if v, ok := provider.(Versioner); ok {
 		versioners[scheme] = v
 	}
+	if s, ok := provider.(Stater); ok {
+		staters[scheme] = s
+	}
+	if w, ok := provider.(Watcher); ok {
+		watchers[scheme] = w
+	}
 	if p, ok := provider.(Provider); ok {
 		providers[scheme] = p
 	}
@@ -131,6 +163,7 @@ func Delete(loc Location) error {
 	if err != nil {
 		return err
 	}
+	logging.Debug("delete", "location", loc)
 	return p.Delete(loc)
 }
 
@@ -140,6 +173,7 @@ func Get(loc Location) (io.ReadCloser, error) {
 	if !ok {
 		return nil, fmt.Errorf("no getter associated with scheme: %v", loc.Type())
 	}
+	logging.Debug("get", "location", loc)
 	return g.Get(loc)
 }
 
@@ -149,6 +183,7 @@ func List(loc Location) ([]string, error) {
 	if !ok {
 		return nil, fmt.Errorf("no lister associated with schem: %v", loc.Type())
 	}
+	logging.Debug("list", "location", loc)
 	return l.List(loc)
 }
 
@@ -158,6 +193,7 @@ func Put(loc Location, rdr io.Reader) error {
 	if !ok {
 		return fmt.Errorf("no putter associated with scheme: %v", loc.Type())
 	}
+	logging.Debug("put", "location", loc)
 	return p.Put(loc, rdr)
 }
 
@@ -169,3 +205,29 @@ func Version(loc Location, previous string) (string, error) {
 	}
 	return v.Version(loc, previous)
 }
+
+// Stat describes the file at the given location
+func Stat(loc Location) (FileInfo, error) {
+	s, ok := staters[loc.Type()]
+	if !ok {
+		return FileInfo{}, fmt.Errorf("no stater associated with scheme: %v", loc.Type())
+	}
+	return s.Stat(loc)
+}
+
+// version identifies a file by its modification time and size, for providers
+// that have nothing better
+func (fi FileInfo) version() string {
+	return fmt.Sprintf("%s-%d", fi.ModTime.UTC().Format("20060102150405"), fi.Size)
+}
+
+// Watch reports changes to the given location. An error is returned if the
+// provider doesn't support watching, in which case Version should be polled.
+func Watch(loc Location, done <-chan struct{}) (<-chan struct{}, error) {
+	w, ok := watchers[loc.Type()]
+	if !ok {
+		return nil, fmt.Errorf("no watcher associated with scheme: %v", loc.Type())
+	}
+	logging.Debug("watch", "location", loc)
+	return w.Watch(loc, done)
+}
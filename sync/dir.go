@@ -0,0 +1,254 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/badgerodon/stack/logging"
+	"github.com/badgerodon/stack/storage"
+)
+
+// DefaultParallel is the default number of concurrent transfers
+var DefaultParallel = 4
+
+// operations in a Change
+const (
+	OpCopy   = "copy"
+	OpDelete = "delete"
+)
+
+type (
+	// DirOptions control how a folder is synchronized
+	DirOptions struct {
+		// Delete removes files from the destination that aren't in the source
+		Delete bool
+		// Force allows Delete to empty the destination when the source is
+		// empty, which is usually a mistake in the source location
+		Force bool
+		// DryRun reports the changes without making them
+		DryRun bool
+		// Parallel is the number of concurrent transfers
+		Parallel int
+		// Progress is called after every change
+		Progress func(Change)
+	}
+
+	// A Change is a file that was copied or deleted
+	Change struct {
+		Op   string
+		Path string
+		Err  error
+	}
+
+	// DirResult counts the changes made by Dir
+	DirResult struct {
+		Copied, Deleted, Unchanged, Failed int
+	}
+
+	// a tree is the files and folders in a folder, by relative path
+	tree struct {
+		files, dirs map[string]bool
+	}
+)
+
+// Dir makes the destination folder a copy of the source folder. Only files
+// that changed are copied, which is decided by size, hash and modification
+// time if the providers can describe files, or by version if both folders
+// use the same provider.
+func Dir(src, dst storage.Location, opts DirOptions) (DirResult, error) {
+	var result DirResult
+	if opts.Parallel <= 0 {
+		opts.Parallel = DefaultParallel
+	}
+
+	srcTree, err := listTree(src)
+	if err != nil {
+		return result, fmt.Errorf("error listing %s: %v", src, err)
+	}
+	dstTree, err := listTree(dst)
+	if err != nil {
+		// the destination is created by copying to it
+		if !os.IsNotExist(err) {
+			return result, fmt.Errorf("error listing %s: %v", dst, err)
+		}
+		dstTree = tree{files: map[string]bool{}, dirs: map[string]bool{}}
+	}
+	// object stores list a missing prefix as empty, so an empty source can't
+	// be told apart from a typo
+	if opts.Delete && !opts.Force && len(srcTree.files) == 0 && len(dstTree.files) > 0 {
+		return result, fmt.Errorf("%s is empty, refusing to delete every file in %s without force", src, dst)
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	report := func(c Change) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case c.Err != nil:
+			result.Failed++
+			if firstErr == nil {
+				firstErr = c.Err
+			}
+			logging.Warn("sync failed", "op", c.Op, "path", c.Path, "error", c.Err)
+		case c.Op == OpCopy:
+			result.Copied++
+		case c.Op == OpDelete:
+			result.Deleted++
+		default:
+			result.Unchanged++
+			return
+		}
+		if opts.Progress != nil {
+			opts.Progress(c)
+		}
+	}
+
+	jobs := make(chan func())
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job()
+			}
+		}()
+	}
+
+	for _, p := range sortedKeys(srcTree.files) {
+		p := p
+		jobs <- func() {
+			from, to := src.Join(p), dst.Join(p)
+			if dstTree.files[p] && unchanged(from, to) {
+				report(Change{Path: p})
+				return
+			}
+			c := Change{Op: OpCopy, Path: p}
+			if !opts.DryRun {
+				c.Err = copyFile(from, to)
+			}
+			report(c)
+		}
+	}
+	if opts.Delete {
+		for _, p := range sortedKeys(dstTree.files) {
+			if srcTree.files[p] {
+				continue
+			}
+			p := p
+			jobs <- func() {
+				c := Change{Op: OpDelete, Path: p}
+				if !opts.DryRun {
+					c.Err = storage.Delete(dst.Join(p))
+				}
+				report(c)
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if opts.Delete && !opts.DryRun && result.Failed == 0 {
+		// remove extraneous folders once they're empty, deepest first. Object
+		// stores don't have folders, so errors are ignored.
+		dirs := sortedKeys(dstTree.dirs)
+		sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+		for _, p := range dirs {
+			if !srcTree.dirs[p] {
+				if err := storage.Delete(dst.Join(p)); err != nil {
+					logging.Debug("error removing folder", "path", p, "error", err)
+				}
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return result, fmt.Errorf("%d of %d changes failed: %v", result.Failed, result.Failed+result.Copied+result.Deleted, firstErr)
+	}
+	return result, nil
+}
+
+// listTree recursively lists a folder
+func listTree(root storage.Location) (tree, error) {
+	t := tree{files: map[string]bool{}, dirs: map[string]bool{}}
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		names, err := storage.List(root.Join(rel))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			isDir := strings.HasSuffix(name, "/")
+			base := path.Base(strings.TrimSuffix(name, "/"))
+			if base == "." || base == "/" || base == "" {
+				continue
+			}
+			p := path.Join(rel, base)
+			if isDir {
+				t.dirs[p] = true
+				if err := walk(p); err != nil {
+					return err
+				}
+			} else {
+				t.files[p] = true
+			}
+		}
+		return nil
+	}
+	return t, walk("")
+}
+
+// unchanged returns true if the destination file is known to be the same as
+// the source file
+func unchanged(src, dst storage.Location) bool {
+	si, serr := storage.Stat(src)
+	di, derr := storage.Stat(dst)
+	if serr == nil && derr == nil {
+		if si.Size >= 0 && di.Size >= 0 {
+			if si.Size != di.Size {
+				return false
+			}
+			if si.Hash != "" && di.Hash != "" {
+				return si.Hash == di.Hash
+			}
+			// the destination was written after the source was last modified
+			if !si.ModTime.IsZero() && !di.ModTime.IsZero() {
+				return !si.ModTime.After(di.ModTime)
+			}
+		} else if si.Hash != "" && di.Hash != "" {
+			return si.Hash == di.Hash
+		}
+	}
+	// versions are only comparable within a provider
+	if src.Type() == dst.Type() {
+		sv, serr := storage.Version(src, "")
+		dv, derr := storage.Version(dst, "")
+		if serr == nil && derr == nil && sv != "" {
+			return sv == dv
+		}
+	}
+	return false
+}
+
+func copyFile(src, dst storage.Location) error {
+	rc, err := storage.Get(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return storage.Put(dst, rc)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,146 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/badgerodon/stack/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFiles(t *testing.T, root string) map[string]string {
+	files := map[string]string{}
+	filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		bs, _ := ioutil.ReadFile(p)
+		rel, _ := filepath.Rel(root, p)
+		files[filepath.ToSlash(rel)] = string(bs)
+		return nil
+	})
+	return files
+}
+
+func TestDir(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp, err := ioutil.TempDir("", "stack-sync-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	srcDir, dstDir := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	src, _ := storage.ParseLocation(srcDir)
+	dst, _ := storage.ParseLocation(dstDir)
+
+	files := map[string]string{
+		"a.txt":          "a",
+		"b/c.txt":        "c",
+		"b/d/e.txt":      "e",
+		"release/v1.tgz": "v1",
+	}
+	writeFiles(t, srcDir, files)
+
+	var changes []string
+	opts := DirOptions{Parallel: 2, Progress: func(c Change) {
+		changes = append(changes, c.Op+" "+c.Path)
+	}}
+
+	// dry run
+	opts.DryRun = true
+	res, err := Dir(src, dst, opts)
+	assert.Nil(err)
+	assert.Equal(DirResult{Copied: 4}, res)
+	_, err = os.Stat(dstDir)
+	assert.True(os.IsNotExist(err))
+
+	// initial copy
+	opts.DryRun = false
+	res, err = Dir(src, dst, opts)
+	assert.Nil(err)
+	assert.Equal(DirResult{Copied: 4}, res)
+	assert.Equal(files, readFiles(t, dstDir))
+
+	// nothing changed
+	res, err = Dir(src, dst, opts)
+	assert.Nil(err)
+	assert.Equal(DirResult{Unchanged: 4}, res)
+
+	// a modified file, a new file and an extraneous file
+	writeFiles(t, srcDir, map[string]string{"b/c.txt": "c2", "f.txt": "f"})
+	writeFiles(t, dstDir, map[string]string{"old/x.txt": "x"})
+	changes = nil
+	res, err = Dir(src, dst, opts)
+	assert.Nil(err)
+	assert.Equal(DirResult{Copied: 2, Unchanged: 3}, res)
+	sort.Strings(changes)
+	assert.Equal([]string{"copy b/c.txt", "copy f.txt"}, changes)
+
+	// a modified file of the same size
+	later := time.Now().Add(time.Minute)
+	writeFiles(t, srcDir, map[string]string{"a.txt": "A"})
+	os.Chtimes(filepath.Join(srcDir, "a.txt"), later, later)
+	res, err = Dir(src, dst, opts)
+	assert.Nil(err)
+	assert.Equal("A", readFiles(t, dstDir)["a.txt"])
+	earlier := time.Now().Add(-time.Minute)
+	os.Chtimes(filepath.Join(srcDir, "a.txt"), earlier, earlier)
+
+	// delete
+	opts.Delete = true
+	changes = nil
+	res, err = Dir(src, dst, opts)
+	assert.Nil(err)
+	assert.Equal(DirResult{Deleted: 1, Unchanged: 5}, res)
+	assert.Equal([]string{"delete old/x.txt"}, changes)
+	_, err = os.Stat(filepath.Join(dstDir, "old"))
+	assert.True(os.IsNotExist(err))
+	assert.Equal(readFiles(t, srcDir), readFiles(t, dstDir))
+}
+
+func TestDirMissingSource(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp, err := ioutil.TempDir("", "stack-sync-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	srcDir, dstDir := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	src, _ := storage.ParseLocation(srcDir)
+	dst, _ := storage.ParseLocation(dstDir)
+	writeFiles(t, dstDir, map[string]string{"keep.txt": "keep"})
+	opts := DirOptions{Delete: true}
+
+	// a missing source is an error, not an empty folder
+	_, err = Dir(src, dst, opts)
+	assert.NotNil(err)
+	assert.Equal(map[string]string{"keep.txt": "keep"}, readFiles(t, dstDir))
+
+	// an empty source only empties the destination when forced
+	os.MkdirAll(srcDir, 0755)
+	_, err = Dir(src, dst, opts)
+	assert.NotNil(err)
+	assert.Equal(map[string]string{"keep.txt": "keep"}, readFiles(t, dstDir))
+
+	opts.Force = true
+	res, err := Dir(src, dst, opts)
+	assert.Nil(err)
+	assert.Equal(DirResult{Deleted: 1}, res)
+	assert.Empty(readFiles(t, dstDir))
+}
@@ -1,71 +1,218 @@
 package sync
 
 import (
-	"log"
+	"math/rand"
 	"sync"
 	"time"
 
+	"github.com/badgerodon/stack/logging"
 	"github.com/badgerodon/stack/storage"
 )
 
-// PollInterval is the time in between looking for new versions
+// PollInterval is the default time in between looking for new versions
 var PollInterval = time.Second * 60
 
-// A Watcher watches for changes
+// defaults for Options
+var (
+	DefaultJitter     = time.Second * 15
+	DefaultMaxBackoff = time.Minute * 10
+)
+
+// jitter has to differ between hosts, so don't depend on the global source
+// being seeded
+var (
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterMu   sync.Mutex
+)
+
+// Options control how often a location is polled
+type Options struct {
+	// Interval is the time in between version checks
+	Interval time.Duration `yaml:"poll_interval,omitempty"`
+	// Jitter is the maximum random time added to each interval, so that
+	// hosts started at the same time don't all poll at once
+	Jitter time.Duration `yaml:"jitter,omitempty"`
+	// MaxBackoff bounds the time between version checks after errors
+	MaxBackoff time.Duration `yaml:"max_backoff,omitempty"`
+}
+
+// A Watcher watches for changes. The new version is sent on C after every
+// change.
 type Watcher struct {
-	C       <-chan struct{}
-	done    chan struct{}
-	stopped bool
-	mu      sync.Mutex
+	C         <-chan string
+	done      chan struct{}
+	check     chan struct{}
+	stopped   bool
+	lastCheck time.Time
+	opts      Options
+	mu        sync.Mutex
+}
+
+// withDefaults fills in the unset options
+func (opts Options) withDefaults() Options {
+	if opts.Interval <= 0 {
+		opts.Interval = PollInterval
+	}
+	if opts.Jitter <= 0 {
+		opts.Jitter = DefaultJitter
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.MaxBackoff < opts.Interval {
+		opts.MaxBackoff = opts.Interval
+	}
+	return opts
+}
+
+// Merge returns the options with any unset fields taken from other
+func (opts Options) Merge(other Options) Options {
+	if opts.Interval <= 0 {
+		opts.Interval = other.Interval
+	}
+	if opts.Jitter <= 0 {
+		opts.Jitter = other.Jitter
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = other.MaxBackoff
+	}
+	return opts
+}
+
+// delay returns the time to wait before the next version check. After
+// errors the interval is doubled for every consecutive failure, up to
+// MaxBackoff.
+func (opts Options) delay(failures int) time.Duration {
+	opts = opts.withDefaults()
+	d := opts.Interval
+	for i := 0; i < failures && d < opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > opts.MaxBackoff {
+		d = opts.MaxBackoff
+	}
+	jitterMu.Lock()
+	j := time.Duration(jitterRand.Int63n(int64(opts.Jitter) + 1))
+	jitterMu.Unlock()
+	return d + j
 }
 
 // Watch looks for changes at the given location
-func Watch(loc storage.Location) (*Watcher, error) {
-	return newWatcher(func(done <-chan struct{}, change chan<- struct{}) {
+func Watch(loc storage.Location, opts Options) (*Watcher, error) {
+	return newWatcher(func(w *Watcher, done <-chan struct{}, change chan<- string) {
 		previous := ""
 		changed := true
-		previous, _ = storage.Version(loc, previous)
-		ticker := time.NewTicker(PollInterval)
-		defer ticker.Stop()
+		previous, err := storage.Version(loc, previous)
+		if err == nil {
+			w.checked()
+		}
+		failures := 0
+		timer := time.NewTimer(w.options().delay(failures))
+		defer timer.Stop()
+
+		// providers that can push changes trigger a check right away, polling
+		// is kept as a fallback
+		pushed, err := storage.Watch(loc, done)
+		if err == nil {
+			go func() {
+				for {
+					select {
+					case <-pushed:
+						w.Check()
+					case <-done:
+						return
+					}
+				}
+			}()
+		}
+
 		for {
 			if changed {
 				select {
-				case change <- struct{}{}:
+				case change <- previous:
 					changed = false
 				case <-done:
 					return
 				}
-			} else {
-				select {
-				case <-ticker.C:
-					next, err := storage.Version(loc, previous)
-					if err != nil {
-						log.Println("[watcher] error getting version:", err)
-						time.Sleep(time.Minute)
-						continue
-					}
-					log.Printf("[watcher] version: %v\n", next)
-					if previous != next {
-						changed = true
-						previous = next
-					}
-				case <-done:
-					return
-				}
+				continue
+			}
+
+			select {
+			case <-timer.C:
+			case <-w.check:
+				timer.Stop()
+			case <-done:
+				return
+			}
+
+			next, err := storage.Version(loc, previous)
+			if err != nil {
+				failures++
+				delay := w.options().delay(failures)
+				logging.Warn("error checking version", "location", loc, "error", err, "failures", failures, "retry_in", delay)
+				timer.Reset(delay)
+				continue
+			}
+			failures = 0
+			timer.Reset(w.options().delay(failures))
+			w.checked()
+			logging.Debug("checked version", "location", loc, "version", next)
+			if previous != next {
+				changed = true
+				previous = next
 			}
 		}
-	}), nil
+	}, opts), nil
 }
 
-func newWatcher(f func(done <-chan struct{}, change chan<- struct{})) *Watcher {
+func newWatcher(f func(w *Watcher, done <-chan struct{}, change chan<- string), opts Options) *Watcher {
 	done := make(chan struct{})
-	change := make(chan struct{})
-	go f(done, change)
-	return &Watcher{
+	change := make(chan string)
+	w := &Watcher{
 		C:       change,
 		done:    done,
+		check:   make(chan struct{}, 1),
 		stopped: false,
+		opts:    opts,
 	}
+	go f(w, done, change)
+	return w
+}
+
+func (w *Watcher) checked() {
+	w.mu.Lock()
+	w.lastCheck = time.Now()
+	w.mu.Unlock()
+}
+
+func (w *Watcher) options() Options {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.opts
+}
+
+// SetOptions changes how often the watcher polls, starting with the next
+// version check
+func (w *Watcher) SetOptions(opts Options) {
+	w.mu.Lock()
+	w.opts = opts
+	w.mu.Unlock()
+}
+
+// Check asks the watcher to look for a new version now instead of waiting
+// for the next poll
+func (w *Watcher) Check() {
+	select {
+	case w.check <- struct{}{}:
+	default:
+	}
+}
+
+// LastCheck returns the time of the last successful version check
+func (w *Watcher) LastCheck() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastCheck
 }
 
 // Stop stops the watcher
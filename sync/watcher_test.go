@@ -0,0 +1,48 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptionsDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := Options{
+		Interval:   time.Second * 30,
+		Jitter:     time.Second * 5,
+		MaxBackoff: time.Minute * 5,
+	}
+	for failures, base := range []time.Duration{
+		time.Second * 30,
+		time.Minute,
+		time.Minute * 2,
+		time.Minute * 4,
+		time.Minute * 5,
+		time.Minute * 5,
+	} {
+		for i := 0; i < 20; i++ {
+			d := opts.delay(failures)
+			assert.True(d >= base && d <= base+opts.Jitter,
+				"expected %v to be in [%v, %v] after %d failures", d, base, base+opts.Jitter, failures)
+		}
+	}
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := Options{Interval: time.Second}.Merge(Options{Interval: time.Hour, Jitter: time.Minute})
+	assert.Equal(Options{Interval: time.Second, Jitter: time.Minute}, opts)
+
+	opts = Options{}.withDefaults()
+	assert.Equal(PollInterval, opts.Interval)
+	assert.Equal(DefaultJitter, opts.Jitter)
+	assert.Equal(DefaultMaxBackoff, opts.MaxBackoff)
+
+	// the backoff is never less than the interval
+	opts = Options{Interval: time.Hour}.withDefaults()
+	assert.Equal(time.Hour, opts.MaxBackoff)
+}
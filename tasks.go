@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/badgerodon/stack/logging"
+)
+
+func (at ApplicationTask) name(i int) string {
+	if at.Name != "" {
+		return at.Name
+	}
+	return "task-" + strconv.Itoa(i+1)
+}
+
+// runTasks runs the application's tasks in its directory with the service
+// environment. Tasks which already succeeded for this version of the
+// application are skipped.
+func runTasks(state *StackState, app Application, extra map[string]string) error {
+	key := app.TaskKey()
+	completed := map[string]struct{}{}
+	for _, name := range state.Tasks[key] {
+		completed[name] = struct{}{}
+	}
+
+	for i, task := range app.Tasks {
+		name := task.name(i)
+		if _, ok := completed[name]; ok {
+			logging.Debug("skip task", "app", app.Name, "task", name)
+			continue
+		}
+		if len(task.Command) == 0 {
+			return fmt.Errorf("task %s has no command", name)
+		}
+
+		env, err := app.Service.environment(app.ApplicationPath(), extra, task.ApplicationService)
+		if err != nil {
+			return fmt.Errorf("task %s: %v", name, err)
+		}
+
+		cmdName := task.Command[0]
+		if _, err := os.Stat(filepath.Join(app.ApplicationPath(), cmdName)); err == nil {
+			cmdName = filepath.Join(app.ApplicationPath(), cmdName)
+		}
+		cmd := exec.Command(cmdName, task.Command[1:]...)
+		cmd.Dir = app.ApplicationPath()
+		cmd.Env = []string{}
+		for k, v := range env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		logging.Info("run task", "app", app.Name, "task", name, "stage", stageInstall)
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("task %s failed: %v", name, err)
+		}
+
+		state.Tasks[key] = append(state.Tasks[key], name)
+		SaveStackState(state)
+	}
+	return nil
+}
+
+// pruneTasks forgets the completed tasks of versions no longer in the config
+func pruneTasks(state *StackState, cfg *Config) {
+	keys := map[string]struct{}{}
+	for _, app := range cfg.Applications {
+		keys[app.TaskKey()] = struct{}{}
+	}
+	for key := range state.Tasks {
+		if _, ok := keys[key]; !ok {
+			delete(state.Tasks, key)
+		}
+	}
+	SaveStackState(state)
+}
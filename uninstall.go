@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/badgerodon/stack/logging"
+)
+
+// uninstall removes the stack service and, unless watcherOnly is set, every
+// application service along with everything stored under the root
+// directory. If keepData is set the extracted applications are left in place.
+func uninstall(keepData, watcherOnly bool) error {
+	var removedServices, removedPaths []string
+	var errs []string
+
+	logging.Info("remove service", "service", "stack")
+	err := serviceManager.Uninstall("stack")
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("stack: %v", err))
+	} else {
+		removedServices = append(removedServices, "stack")
+	}
+
+	if !watcherOnly {
+		names := map[string]struct{}{}
+		services, err := serviceManager.List()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("error listing services: %v", err))
+		}
+		for _, name := range services {
+			if strings.HasPrefix(name, "stack-") {
+				names[name] = struct{}{}
+			}
+		}
+		// include services from the state in case the manager lost track of
+		// them. Validating the state would remove applications, so it's read
+		// as is.
+		for _, app := range LoadStackState().Applications {
+			for _, name := range app.ServiceNames() {
+				names[name] = struct{}{}
+			}
+		}
+		var sorted []string
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+
+		for _, name := range sorted {
+			logging.Info("remove service", "service", name)
+			err := serviceManager.Uninstall(name)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			removedServices = append(removedServices, name)
+		}
+	}
+
+	// the local manager runs services with a runner started by this process,
+	// which has to stop before its state file is removed
+	if closer, ok := serviceManager.(io.Closer); ok {
+		logging.Info("stop service runner")
+		closer.Close()
+	}
+
+	if !watcherOnly {
+		paths := []string{
+			"downloads", "run", "tmp",
+			"state.json", "registry.json", "services.state", "webhook-secret",
+			"stack", "stack.old", "stack.new", "stack.update",
+		}
+		if !keepData {
+			paths = append(paths, "applications")
+		}
+		for _, p := range paths {
+			p = filepath.Join(rootDir, p)
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+			logging.Info("remove", "path", p)
+			err := os.RemoveAll(p)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", p, err))
+				continue
+			}
+			removedPaths = append(removedPaths, p)
+		}
+		if !keepData {
+			// only succeeds if nothing else is left in the root directory
+			if os.Remove(rootDir) == nil {
+				removedPaths = append(removedPaths, rootDir)
+			}
+		}
+	}
+
+	fmt.Printf("removed %d services:\n", len(removedServices))
+	for _, name := range removedServices {
+		fmt.Println("  " + name)
+	}
+	if !watcherOnly {
+		fmt.Printf("removed %d paths:\n", len(removedPaths))
+		for _, p := range removedPaths {
+			fmt.Println("  " + p)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to uninstall:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/badgerodon/stack/service"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeManager keeps services in memory
+type fakeManager struct {
+	services map[string]service.Service
+}
+
+func (m *fakeManager) Check() error { return nil }
+
+func (m *fakeManager) Install(svc service.Service) error {
+	m.services[svc.Name] = svc
+	return nil
+}
+
+func (m *fakeManager) Uninstall(name string) error {
+	delete(m.services, name)
+	return nil
+}
+
+func (m *fakeManager) List() ([]string, error) {
+	var names []string
+	for name := range m.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *fakeManager) Status(name string) (service.Status, error) {
+	return service.Status{Name: name}, nil
+}
+
+func TestUninstall(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp, err := ioutil.TempDir("", "stack-uninstall-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer func(dir string, mgr service.Manager) {
+		rootDir, serviceManager = dir, mgr
+	}(rootDir, serviceManager)
+	rootDir = filepath.Join(tmp, "stack")
+	mgr := &fakeManager{services: map[string]service.Service{}}
+	serviceManager = mgr
+
+	// everything the stack creates in its root directory
+	for _, name := range []string{
+		"applications/app/bin/app", "downloads/app.tgz", "run/control/stack.sock", "tmp/x",
+		"state.json", "registry.json", "services.state", "webhook-secret",
+		"stack", "stack.old", "stack.new", "stack.update",
+	} {
+		p := filepath.Join(rootDir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mgr.Install(service.Service{Name: "stack"})
+	mgr.Install(service.Service{Name: "stack-app"})
+
+	assert.Nil(uninstall(false, false))
+	assert.Empty(mgr.services)
+	_, err = os.Stat(rootDir)
+	assert.True(os.IsNotExist(err), "expected %s to be removed, got %v", rootDir, err)
+}
@@ -1,43 +1,165 @@
 package main
 
 import (
-	"log"
 	"time"
 
+	"github.com/badgerodon/stack/logging"
 	"github.com/badgerodon/stack/storage"
 	"github.com/badgerodon/stack/sync"
 	"github.com/cenkalti/backoff"
 )
 
-func watch(src string) error {
+type watchOptions struct {
+	MetricsAddr   string
+	WebhookAddr   string
+	WebhookSecret string
+	Poll          sync.Options
+	Maintenance   []MaintenanceWindow
+}
+
+func watch(src string, opts watchOptions) error {
+	// a new stack binary has to apply the config before its deadline
+	stopSelfUpdate, err := watchSelfUpdate()
+	if err != nil {
+		return err
+	}
+	defer stopSelfUpdate()
+
 	loc, err := storage.ParseLocation(src)
 	if err != nil {
 		return err
 	}
 
-	watcher, err := sync.Watch(loc)
+	watcher, err := sync.Watch(loc, opts.Poll)
 	if err != nil {
 		return err
 	}
 	defer watcher.Stop()
 
-	// TODO: a better approach here would be to use a channel to retry on,
-	//       then if you jacked up the config, it would pick up the change
-	//       in the middle of all the retries. As it stands now it would take a
-	//       minute to fix itself.
+	if opts.MetricsAddr != "" {
+		serveMetrics(opts.MetricsAddr, watcher)
+	}
+	if opts.WebhookAddr != "" {
+		err = serveWebhooks(opts.WebhookAddr, opts.WebhookSecret, watcher)
+		if err != nil {
+			return err
+		}
+	}
+
+	d := newDaemon(src)
+	d.watcher = watcher
+	d.pollOptions = opts.Poll
+	d.maintenance = opts.Maintenance
+	defer d.stopSources()
+	// the daemon works without the control API, ie where unix sockets
+	// aren't supported
+	ctl, err := serveControl(d)
+	if err != nil {
+		logging.Warn("control api disabled", "error", err)
+	} else {
+		defer ctl.Close()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go d.monitorServices(done)
+
+	// a failed apply is retried with a backoff. A new version cancels the
+	// retries of the previous one and is applied right away.
 	eb := backoff.NewExponentialBackOff()
 	eb.MaxElapsedTime = time.Minute
+	var retry *time.Timer
+	var retryC <-chan time.Time
+	cancelRetry := func() {
+		if retry != nil {
+			retry.Stop()
+			retry, retryC = nil, nil
+		}
+	}
+	attempt := func(first bool) error {
+		cancelRetry()
+		if first {
+			d.clearRetry()
+			eb.Reset()
+		}
+		err := d.apply()
+		if err == nil || err == errRestart {
+			d.clearRetry()
+			return err
+		}
+		next := eb.NextBackOff()
+		d.retryFailed(err, next)
+		if next != backoff.Stop {
+			retry = time.NewTimer(next)
+			retryC = retry.C
+		}
+		return nil
+	}
+
+	// later waves of a rollout wait for earlier ones, so check periodically
+	// if they can proceed
+	rollouts := time.NewTicker(rolloutCheckInterval)
+	defer rollouts.Stop()
+	// versions queued outside of a maintenance window are applied when the
+	// next one opens
+	windows := time.NewTicker(time.Minute)
+	defer windows.Stop()
 
-	for range watcher.C {
-		log.Println("[watch] new version")
-		backoff.Retry(func() error {
-			err := apply(src)
-			if err != nil {
-				log.Printf("[watch] error installing: %v\n", err)
+	for {
+		var err error
+		select {
+		case version := <-watcher.C:
+			logging.Info("new version", "location", src, "version", version)
+			d.publish(Event{Type: "new-version", Message: version})
+			cancelRetry()
+			if d.deferApply(version) {
+				continue
+			}
+			err = attempt(true)
+		case <-retryC:
+			retry, retryC = nil, nil
+			if d.deferApply(d.Status().Version) {
+				continue
+			}
+			err = attempt(false)
+		case name := <-d.sourceChanged:
+			if d.deferApply(d.Status().Version, name) {
+				continue
+			}
+			err = attempt(true)
+		case <-rollouts.C:
+			if retryC != nil || !d.checkRollouts() {
+				continue
 			}
+			if d.deferApply(d.Status().Version) {
+				continue
+			}
+			err = attempt(true)
+		case <-windows.C:
+			st := d.Status()
+			if !st.Pending || st.Paused {
+				continue
+			}
+			if open, _ := d.maintenanceOpen(); !open {
+				continue
+			}
+			logging.Info("maintenance window open", "version", st.Version)
+			err = attempt(true)
+		case <-d.wake:
+			if d.deferApply(d.Status().Version) {
+				continue
+			}
+			err = attempt(true)
+		case result := <-d.requests:
+			err = d.apply()
+			if err == nil {
+				cancelRetry()
+				d.clearRetry()
+			}
+			result <- err
+		}
+		if err == errRestart {
 			return err
-		}, eb)
+		}
 	}
-
-	return nil
 }
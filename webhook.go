@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	stacksync "github.com/badgerodon/stack/sync"
+
+	"github.com/badgerodon/stack/logging"
+)
+
+// maxWebhookBody limits the size of webhook payloads
+const maxWebhookBody = 5 << 20
+
+// webhookHandler triggers a version check when a push webhook is received.
+//
+// GitHub and Bitbucket send an HMAC of the body in X-Hub-Signature-256 (or
+// the older sha1 X-Hub-Signature). Any other sender can POST with a
+// X-Stack-Signature: sha256=<hex hmac of the body> header.
+type webhookHandler struct {
+	secret  []byte
+	watcher *stacksync.Watcher
+}
+
+// validSignature checks a "<algorithm>=<hex>" signature of body
+func (h *webhookHandler) validSignature(signature string, body []byte) bool {
+	var mac hash.Hash
+	switch {
+	case strings.HasPrefix(signature, "sha256="):
+		mac = hmac.New(sha256.New, h.secret)
+	case strings.HasPrefix(signature, "sha1="):
+		mac = hmac.New(sha1.New, h.secret)
+	default:
+		return false
+	}
+	expected, err := hex.DecodeString(signature[strings.Index(signature, "=")+1:])
+	if err != nil {
+		return false
+	}
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// isPush returns false for events that shouldn't trigger a check, like
+// the ping sent when a webhook is created
+func isPush(r *http.Request) bool {
+	if evt := r.Header.Get("X-GitHub-Event"); evt != "" {
+		return evt == "push"
+	}
+	if evt := r.Header.Get("X-Event-Key"); evt != "" {
+		return evt == "repo:push" || evt == "repo:refs_changed"
+	}
+	return true
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+
+	signature := r.Header.Get("X-Hub-Signature-256")
+	if signature == "" {
+		signature = r.Header.Get("X-Hub-Signature")
+	}
+	if signature == "" {
+		signature = r.Header.Get("X-Stack-Signature")
+	}
+	if !h.validSignature(signature, body) {
+		logging.Warn("invalid webhook signature", "remote", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if isPush(r) {
+		logging.Info("webhook received, checking for a new version")
+		h.watcher.Check()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveWebhooks listens for push webhooks at addr. Polling continues as a
+// fallback in case a webhook is missed.
+func serveWebhooks(addr, secret string, watcher *stacksync.Watcher) error {
+	if secret == "" {
+		return fmt.Errorf("a webhook secret is required")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", &webhookHandler{
+		secret:  []byte(secret),
+		watcher: watcher,
+	})
+	go func() {
+		logging.Info("webhooks listening", "addr", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			logging.Error("webhooks stopped", "error", err)
+		}
+	}()
+	return nil
+}